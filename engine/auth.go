@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	adminRole = "admin"
+)
+
+type Claims struct {
+	Rid     string   `json:"rid"`
+	Uid     string   `json:"uid"`
+	Methods []string `json:"methods"`
+	Role    string   `json:"role"`
+	jwt.RegisteredClaims
+}
+
+func (impl *R) authorize(call *Call) error {
+	auth := impl.conf.Auth
+	if auth.Secret == "" && auth.PublicKey == "" {
+		if moderated(call.Method) || call.Method == "drain" {
+			return buildError(ErrorUnauthorized, fmt.Errorf("method %s requires the auth configured", call.Method))
+		}
+		return nil
+	}
+	if call.Token == "" {
+		return buildError(ErrorUnauthorized, fmt.Errorf("token required for %s", call.Method))
+	}
+
+	var claims Claims
+	_, err := jwt.ParseWithClaims(call.Token, &claims, func(t *jwt.Token) (any, error) {
+		switch t.Method.Alg() {
+		case jwt.SigningMethodHS256.Alg():
+			if auth.Secret != "" {
+				return []byte(auth.Secret), nil
+			}
+		case jwt.SigningMethodEdDSA.Alg():
+			if auth.PublicKey != "" {
+				pub, err := hex.DecodeString(auth.PublicKey)
+				if err != nil || len(pub) != ed25519.PublicKeySize {
+					return nil, fmt.Errorf("invalid public key %s", auth.PublicKey)
+				}
+				return ed25519.PublicKey(pub), nil
+			}
+		}
+		return nil, fmt.Errorf("unsupported signing method %s", t.Method.Alg())
+	}, jwt.WithExpirationRequired(), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil {
+		return buildError(ErrorUnauthorized, err)
+	}
+
+	if !slices.Contains(claims.Methods, call.Method) {
+		return buildError(ErrorUnauthorized, fmt.Errorf("method %s not allowed", call.Method))
+	}
+	if moderated(call.Method) && claims.Role != moderatorRole {
+		return buildError(ErrorUnauthorized, fmt.Errorf("method %s requires %s role", call.Method, moderatorRole))
+	}
+	if call.Method == "drain" && claims.Role != adminRole {
+		return buildError(ErrorUnauthorized, fmt.Errorf("method %s requires %s role", call.Method, adminRole))
+	}
+	rid, uid := callIds(call)
+	if claims.Rid != "" && rid != nil && claims.Rid != *rid {
+		return buildError(ErrorUnauthorized, fmt.Errorf("rid %s not match %s", *rid, claims.Rid))
+	}
+	if claims.Uid != "" && uid != nil && claims.Uid != *uid {
+		return buildError(ErrorUnauthorized, fmt.Errorf("uid %s not match %s", *uid, claims.Uid))
+	}
+	return nil
+}
+
+// callIds returns the rid and uid params of the call, nil if the method
+// doesn't take it, and an empty string if the param is malformed.
+func callIds(call *Call) (*string, *string) {
+	param := func(i int) *string {
+		var s string
+		if len(call.Params) > i {
+			s, _ = call.Params[i].(string)
+		}
+		return &s
+	}
+	switch call.Method {
+	case "info", "drain":
+		return nil, nil
+	case "turn":
+		return nil, param(0)
+	case "list", "speakers", "record_start", "record_stop", "mute", "kick", "ban":
+		return param(0), nil
+	default:
+		return param(0), param(1)
+	}
+}
+
+// moderated tells whether the method acts on the other peers of the room,
+// which requires the moderator role besides the method allowed.
+func moderated(method string) bool {
+	switch method {
+	case "mute", "kick", "ban":
+		return true
+	}
+	return false
+}
+
+func bearerToken(header string) string {
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return header[7:]
+	}
+	return ""
+}
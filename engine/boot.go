@@ -1,6 +1,13 @@
 package engine
 
-import "github.com/MixinNetwork/mixin/logger"
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
 
 func Boot(cp string) {
 	conf, err := Setup(cp)
@@ -14,6 +21,41 @@ func Boot(cp string) {
 		panic(err)
 	}
 
+	if conf.Turn.Listen != "" {
+		ts, err := ServeTURN(engine, conf)
+		if err != nil {
+			panic(err)
+		}
+		defer ts.Close()
+	}
+
 	go engine.Loop()
-	ServeRPC(engine, conf)
+	go engine.SpeakerLoop()
+	go engine.webhook.Loop()
+	if conf.Monitor.Endpoint != "" {
+		go engine.ReportLoop(conf)
+	}
+	go func() {
+		sc := make(chan os.Signal, 1)
+		signal.Notify(sc, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sc
+		logger.Printf("Boot() signal %s\n", sig)
+		engine.Drain()
+	}()
+
+	ec := make(chan error)
+	go func() {
+		ec <- ServeRPC(engine, conf)
+	}()
+	select {
+	case err := <-ec:
+		logger.Printf("ServeRPC() error %v\n", err)
+	case <-engine.drained:
+		deadline := conf.Engine.DrainTimeout
+		if deadline <= 0 {
+			deadline = engineDrainDefaultDeadline
+		}
+		engine.Shutdown(time.Duration(deadline) * time.Second)
+		engine.webhook.Flush(webhookFlushDeadline)
+	}
 }
@@ -9,19 +9,54 @@ import (
 
 type Configuration struct {
 	Engine struct {
-		Interface string `toml:"interface"`
-		Address   string `toml:"address"`
-		LogLevel  int    `toml:"log-level"`
-		PortMin   uint16 `toml:"port-min"`
-		PortMax   uint16 `toml:"port-max"`
+		Interface    string `toml:"interface"`
+		Address      string `toml:"address"`
+		LogLevel     int    `toml:"log-level"`
+		PortMin      uint16 `toml:"port-min"`
+		PortMax      uint16 `toml:"port-max"`
+		DrainTimeout int    `toml:"drain-timeout"`
+		LastN        int    `toml:"last-n"`
+		BanDuration  int    `toml:"ban-duration"`
+		UDPPort      int    `toml:"udp-port"`
+		TCPPort      int    `toml:"tcp-port"`
+		Trickle      bool   `toml:"trickle"`
 	} `toml:"engine"`
 	Turn struct {
-		Host   string `toml:"host"`
-		Secret string `toml:"secret"`
+		Host         string `toml:"host"`
+		Secret       string `toml:"secret"`
+		Listen       string `toml:"listen"`
+		Realm        string `toml:"realm"`
+		RelayAddress string `toml:"relay-address"`
+		RelayPortMin uint16 `toml:"relay-port-min"`
+		RelayPortMax uint16 `toml:"relay-port-max"`
 	} `toml:"turn"`
 	RPC struct {
-		Port int `toml:"port"`
+		Port    int      `toml:"port"`
+		Origins []string `toml:"origins"`
 	} `toml:"rpc"`
+	Monitor struct {
+		Endpoint string `toml:"endpoint"`
+		Id       string `toml:"id"`
+		URL      string `toml:"url"`
+		Secret   string `toml:"secret"`
+	} `toml:"monitor"`
+	Callback struct {
+		Secret           string `toml:"secret"`
+		Timeout          int    `toml:"timeout"`
+		QueueSize        int    `toml:"queue-size"`
+		Retries          int    `toml:"retries"`
+		BreakerThreshold int    `toml:"breaker-threshold"`
+		BreakerCooldown  int    `toml:"breaker-cooldown"`
+		DeadLetter       string `toml:"dead-letter"`
+		OnTrack          string `toml:"ontrack"`
+	} `toml:"callback"`
+	Record struct {
+		Dir string `toml:"dir"`
+	} `toml:"record"`
+	Auth struct {
+		Secret    string `toml:"secret"`
+		PublicKey string `toml:"public-key"`
+	} `toml:"auth"`
 }
 
 func Setup(path string) (*Configuration, error) {
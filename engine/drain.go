@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	engineDrainCheckPeriod     = 1 * time.Second
+	engineDrainDefaultDeadline = 600
+)
+
+// Drain stops the engine from taking new rooms, the existing rooms keep
+// running until Shutdown, it's safe to call Drain many times.
+func (engine *Engine) Drain() {
+	engine.drainOnce.Do(func() {
+		engine.rooms.Lock()
+		engine.State.Draining = true
+		engine.rooms.Unlock()
+		logger.Printf("Engine.Drain() now\n")
+		close(engine.drained)
+	})
+}
+
+func (engine *Engine) Draining() bool {
+	engine.rooms.RLock()
+	defer engine.rooms.RUnlock()
+
+	return engine.State.Draining
+}
+
+// Shutdown waits the rooms to be empty or the deadline to pass, then closes
+// all the remaining peers.
+func (engine *Engine) Shutdown(deadline time.Duration) {
+	logger.Printf("Engine.Shutdown(%s) now\n", deadline)
+	start := time.Now()
+	for time.Since(start) < deadline {
+		if len(engine.activePeers()) == 0 {
+			break
+		}
+		time.Sleep(engineDrainCheckPeriod)
+	}
+
+	engine.stopRecordings()
+	peers := engine.activePeers()
+	for _, p := range peers {
+		p.Close(peerCloseDrain)
+	}
+	logger.Printf("Engine.Shutdown(%s) closed %d peers in %s\n", deadline, len(peers), time.Since(start))
+}
+
+func (engine *Engine) activePeers() []*Peer {
+	var peers []*Peer
+	for _, pm := range engine.snapshot() {
+		pm.RLock()
+		for _, p := range pm.m {
+			p.RLock()
+			if p.cid != peerTrackClosedId {
+				peers = append(peers, p)
+			}
+			p.RUnlock()
+		}
+		pm.RUnlock()
+	}
+	return peers
+}
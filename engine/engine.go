@@ -7,18 +7,24 @@ import (
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/ice/v2"
 )
 
 const (
 	engineStateLoopPeriod = 60 * time.Second
+	engineReapGracePeriod = 60 * time.Second
 )
 
 type State struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 	ActivePeers int       `json:"active_peers"`
+	ListenPeers int       `json:"listen_peers"`
 	ClosedPeers int       `json:"closed_peers"`
 	ActiveRooms int       `json:"active_rooms"`
 	ClosedRooms int       `json:"closed_rooms"`
+	ReapedPeers int       `json:"reaped_peers"`
+	ReapedRooms int       `json:"reaped_rooms"`
+	Draining    bool      `json:"draining"`
 }
 
 type Engine struct {
@@ -27,8 +33,20 @@ type Engine struct {
 	PortMin   uint16
 	PortMax   uint16
 
-	State State
-	rooms *rmap
+	LastN       int
+	BanDuration time.Duration
+
+	udpMux ice.UDPMux
+	tcpMux ice.TCPMux
+
+	State      State
+	rooms      *rmap
+	moderation *moderation
+	webhook    *Webhook
+	notify     func(rid string)
+
+	drainOnce sync.Once
+	drained   chan struct{}
 }
 
 func BuildEngine(conf *Configuration) (*Engine, error) {
@@ -37,11 +55,23 @@ func BuildEngine(conf *Configuration) (*Engine, error) {
 		return nil, err
 	}
 	engine := &Engine{
-		IP:        ip,
-		Interface: conf.Engine.Interface,
-		PortMin:   conf.Engine.PortMin,
-		PortMax:   conf.Engine.PortMax,
-		rooms:     rmapAllocate(),
+		IP:          ip,
+		Interface:   conf.Engine.Interface,
+		PortMin:     conf.Engine.PortMin,
+		PortMax:     conf.Engine.PortMax,
+		LastN:       conf.Engine.LastN,
+		BanDuration: time.Duration(conf.Engine.BanDuration) * time.Second,
+		rooms:       rmapAllocate(),
+		moderation:  moderationAllocate(),
+		webhook:     BuildWebhook(conf),
+		drained:     make(chan struct{}),
+	}
+	if engine.BanDuration <= 0 {
+		engine.BanDuration = moderationBanDuration
+	}
+	err = engine.listenICE(conf.Engine.UDPPort, conf.Engine.TCPPort)
+	if err != nil {
+		return nil, err
 	}
 	logger.Printf("BuildEngine(IP: %s, Interface: %s, Ports: %d-%d)\n", engine.IP, engine.Interface, engine.PortMin, engine.PortMax)
 	return engine, nil
@@ -49,37 +79,143 @@ func BuildEngine(conf *Configuration) (*Engine, error) {
 
 func (engine *Engine) Loop() {
 	for {
-		engine.rooms.RLock()
+		peers, rooms := engine.reap()
+		state := engine.count()
 
+		engine.rooms.Lock()
 		engine.State.UpdatedAt = time.Now()
-		engine.State.ActiveRooms = 0
-		engine.State.ClosedRooms = 0
-		engine.State.ActivePeers = 0
-		engine.State.ClosedPeers = 0
-
-		for _, pm := range engine.rooms.m {
-			pm.RLock()
-			ap, cp := 0, 0
-			for _, p := range pm.m {
-				if p.cid == peerTrackClosedId {
-					cp += 1
-				} else {
-					ap += 1
-				}
+		engine.State.ActivePeers = state.ActivePeers
+		engine.State.ListenPeers = state.ListenPeers
+		engine.State.ClosedPeers = state.ClosedPeers
+		engine.State.ActiveRooms = state.ActiveRooms
+		engine.State.ClosedRooms = state.ClosedRooms
+		engine.State.ReapedPeers += peers
+		engine.State.ReapedRooms += rooms
+		engine.rooms.Unlock()
+		time.Sleep(engineStateLoopPeriod)
+	}
+}
+
+// current returns the state counted now, with the reaped numbers and the
+// draining flag of the last state.
+func (engine *Engine) current() State {
+	state := engine.count()
+	engine.rooms.RLock()
+	state.ReapedPeers = engine.State.ReapedPeers
+	state.ReapedRooms = engine.State.ReapedRooms
+	state.Draining = engine.State.Draining
+	engine.rooms.RUnlock()
+	state.UpdatedAt = time.Now()
+	return state
+}
+
+// snapshot returns the rooms of the engine, so that the callers don't lock
+// the rooms one by one while holding the rooms lock.
+func (engine *Engine) snapshot() []*pmap {
+	rm := engine.rooms
+	rm.RLock()
+	defer rm.RUnlock()
+
+	rooms := make([]*pmap, 0, len(rm.m))
+	for _, pm := range rm.m {
+		rooms = append(rooms, pm)
+	}
+	return rooms
+}
+
+// count returns the peers and rooms numbers of the state, the listeners
+// are not counted as active peers.
+func (engine *Engine) count() State {
+	var state State
+	for _, pm := range engine.snapshot() {
+		pm.RLock()
+		open := 0
+		for _, p := range pm.m {
+			switch {
+			case p.cid == peerTrackClosedId:
+				state.ClosedPeers += 1
+			case p.listener:
+				state.ListenPeers += 1
+				open += 1
+			default:
+				state.ActivePeers += 1
+				open += 1
 			}
-			engine.State.ActivePeers += ap
-			engine.State.ClosedPeers += cp
-			if ap > 0 {
-				engine.State.ActiveRooms += 1
-			} else {
-				engine.State.ClosedRooms += 1
+		}
+		if open > 0 {
+			state.ActiveRooms += 1
+		} else {
+			state.ClosedRooms += 1
+		}
+		pm.RUnlock()
+	}
+	return state
+}
+
+// reap removes the peers closed longer than the grace period, unlinks them
+// from the remaining peers, and drops the rooms left empty. Each room is
+// reaped with its own lock, and the rooms lock is only taken to drop the
+// empty rooms which are not busy.
+func (engine *Engine) reap() (int, int) {
+	var peers int
+	var empty []*pmap
+	for _, pm := range engine.snapshot() {
+		n, left := pm.reap()
+		peers += n
+		if left == 0 {
+			empty = append(empty, pm)
+		}
+	}
+
+	rooms := 0
+	if len(empty) > 0 {
+		rm := engine.rooms
+		rm.Lock()
+		for _, pm := range empty {
+			if rm.m[pm.id] != pm || !pm.TryLock() {
+				continue
+			}
+			if len(pm.m) == 0 {
+				pm.reaped = true
+				delete(rm.m, pm.id)
+				engine.moderation.clear(pm.id)
+				rooms += 1
 			}
-			pm.RUnlock()
+			pm.Unlock()
 		}
+		rm.Unlock()
+	}
+	if peers > 0 || rooms > 0 {
+		logger.Printf("Engine.reap() %d peers and %d rooms\n", peers, rooms)
+	}
+	return peers, rooms
+}
 
-		engine.rooms.RUnlock()
-		time.Sleep(engineStateLoopPeriod)
+// reap removes the closed peers of the room after the grace period, and
+// returns the number of peers removed and left.
+func (room *pmap) reap() (int, int) {
+	room.Lock()
+	defer room.Unlock()
+
+	reaped := make(map[string]bool)
+	for uid, p := range room.m {
+		p.RLock()
+		if p.cid == peerTrackClosedId && time.Since(p.closedAt) > engineReapGracePeriod {
+			reaped[uid] = true
+		}
+		p.RUnlock()
+	}
+	for uid := range reaped {
+		delete(room.m, uid)
 	}
+	if len(reaped) > 0 {
+		for _, p := range room.m {
+			p.Lock()
+			p.unlink(reaped)
+			p.Unlock()
+		}
+	}
+	return len(reaped), len(room.m)
 }
 
 func getIPFromInterface(iname string, addr string) (string, error) {
@@ -114,14 +250,22 @@ func getIPFromInterface(iname string, addr string) (string, error) {
 
 type pmap struct {
 	sync.RWMutex
-	id string
-	m  map[string]*Peer
+	id        string
+	m         map[string]*Peer
+	speakers  []*Speaker
+	dominant  string
+	reaped    bool
+	recording *Recording
+	mixer     *Mixer
+	recent    []string
+	empty     bool
 }
 
 func pmapAllocate(id string) *pmap {
 	pm := new(pmap)
 	pm.id = id
 	pm.m = make(map[string]*Peer)
+	pm.speakers = make([]*Speaker, 0)
 	return pm
 }
 
@@ -159,6 +303,19 @@ func (engine *Engine) GetRoom(rid string) *pmap {
 	return rm.m[rid]
 }
 
+// LockRoom returns the locked room, it retries if the room has just been
+// reaped, so that peers never join a room removed from the engine.
+func (engine *Engine) LockRoom(rid string) *pmap {
+	for {
+		pm := engine.GetRoom(rid)
+		pm.Lock()
+		if !pm.reaped {
+			return pm
+		}
+		pm.Unlock()
+	}
+}
+
 func (room *pmap) get(uid, cid string) (*Peer, error) {
 	peer := room.m[uid]
 	if peer == nil {
@@ -172,3 +329,14 @@ func (room *pmap) get(uid, cid string) (*Peer, error) {
 	}
 	return peer, nil
 }
+
+// active tells whether the room has any live peers other than uid, the
+// room is considered new otherwise.
+func (room *pmap) active(uid string) bool {
+	for i, p := range room.m {
+		if i != uid && p.cid != peerTrackClosedId {
+			return true
+		}
+	}
+	return false
+}
@@ -9,10 +9,14 @@ const (
 	ErrorInvalidParams           = 5001000
 	ErrorInvalidSDP              = 5001001
 	ErrorInvalidCandidate        = 5001002
+	ErrorUnauthorized            = 5001003
 	ErrorRoomFull                = 5002000
 	ErrorPeerNotFound            = 5002001
 	ErrorPeerClosed              = 5002002
 	ErrorTrackNotFound           = 5002003
+	ErrorEngineDraining          = 5002004
+	ErrorRecordingNotFound       = 5002005
+	ErrorPeerBanned              = 5002006
 	ErrorServerNewPeerConnection = 5003000
 	ErrorServerCreateOffer       = 5003001
 	ErrorServerSetLocalOffer     = 5003002
@@ -22,6 +26,8 @@ const (
 	ErrorServerCreateAnswer      = 5003006
 	ErrorServerSetLocalAnswer    = 5003007
 	ErrorServerSetRemoteAnswer   = 5003008
+	ErrorServerRecord            = 5003009
+	ErrorServerMixer             = 5003010
 	ErrorServerTimeout           = 5003999
 )
 
@@ -41,6 +47,9 @@ func buildError(code int, err error) error {
 	if code >= ErrorServerNewPeerConnection && code <= ErrorServerTimeout {
 		status = http.StatusInternalServerError
 	}
+	if code == ErrorUnauthorized {
+		status = http.StatusUnauthorized
+	}
 	return Error{
 		Status:      status,
 		Code:        code,
@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"net"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+const iceTCPReadBufferSize = 8
+
+// listenICE serves the ICE of all the peers on the single UDP port, which
+// are demultiplexed by the ICE ufrag, and the ICE-TCP on the TCP port for
+// the clients behind UDP blocking networks, 0 to disable either of them.
+func (engine *Engine) listenICE(udpPort, tcpPort int) error {
+	if udpPort > 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(udpPort,
+			ice.UDPMuxFromPortWithInterfaceFilter(func(in string) bool { return in == engine.Interface }),
+			ice.UDPMuxFromPortWithNetworks(ice.NetworkTypeUDP4))
+		if err != nil {
+			return err
+		}
+		engine.udpMux = mux
+	}
+	if tcpPort > 0 {
+		l, err := net.ListenTCP("tcp4", &net.TCPAddr{Port: tcpPort})
+		if err != nil {
+			return err
+		}
+		engine.tcpMux = webrtc.NewICETCPMux(nil, l, iceTCPReadBufferSize)
+	}
+	logger.Printf("Engine.listenICE(%d, %d)\n", udpPort, tcpPort)
+	return nil
+}
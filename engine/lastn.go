@@ -0,0 +1,406 @@
+package engine
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// updateRecent moves the active speakers to the front of the recent list,
+// the new publishers are appended by their levels.
+func (room *pmap) updateRecent(speakers []*Speaker, publishers map[string]bool) {
+	active := make(map[string]bool)
+	front := make([]string, 0)
+	for _, s := range speakers {
+		if s.Active && publishers[s.Id] {
+			active[s.Id] = true
+			front = append(front, s.Id)
+		}
+	}
+	before := make([]string, 0, len(room.recent))
+	for _, uid := range room.recent {
+		if publishers[uid] {
+			before = append(before, uid)
+		}
+	}
+	for _, s := range speakers {
+		if publishers[s.Id] && !slices.Contains(before, s.Id) {
+			before = append(before, s.Id)
+		}
+	}
+	after := front
+	for _, uid := range before {
+		if !active[uid] {
+			after = append(after, uid)
+		}
+	}
+	room.recent = after
+}
+
+// switchSlots assigns the slots of all the last N peers subscribed, the
+// room should be locked by the caller. The peers busy are left to the next
+// call.
+func (room *pmap) switchSlots() {
+	for _, p := range room.m {
+		if !p.TryLock() {
+			continue
+		}
+		if p.cid != peerTrackClosedId && p.lastN > 0 && len(p.slots) > 0 {
+			added, removed := room.assignSlots(p)
+			if len(added) > 0 || len(removed) > 0 {
+				p.event(p.cid, "onsubscription", map[string]any{"added": added, "removed": removed})
+			}
+		}
+		p.Unlock()
+	}
+}
+
+// Slot is a fixed sender of a last N subscriber, the publishers forwarded
+// to the subscriber are switched on the slots with ReplaceTrack, so the
+// active speakers change without any renegotiation. The audio and video
+// slots of the same index share the stream id and carry the same publisher.
+// Each slot sends a single codec, the one of its idle track, so each index
+// has a video slot for every video codec published in the room, and a track
+// is only switched to the slot of its codec.
+type Slot struct {
+	sync.Mutex
+	id        string
+	index     int
+	kind      webrtc.RTPCodecType
+	codec     string
+	rtp       *webrtc.RTPSender
+	idle      *webrtc.TrackLocalStaticRTP
+	last      *Selection
+	publisher *Peer
+	track     *Track
+	sel       *Selection
+}
+
+// recentN returns the n most recently active speakers except the uid.
+func recentN(recent []string, uid string, n int) []string {
+	ids := make([]string, 0, n)
+	for _, id := range recent {
+		if len(ids) == n {
+			break
+		}
+		if id != uid {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func slotKinds(peer *Peer) []webrtc.RTPCodecType {
+	if peer.mixed != nil {
+		return []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}
+	}
+	return []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo}
+}
+
+func (peer *Peer) slot(index int, kind webrtc.RTPCodecType, codec string) *Slot {
+	for _, s := range peer.slots {
+		if s.index == index && s.kind == kind && strings.EqualFold(s.codec, codec) {
+			return s
+		}
+	}
+	return nil
+}
+
+// slotCodecs returns the codecs of the slots of each index, the audio one
+// and the video codecs published in the room.
+func slotCodecs(peer *Peer, video []string) map[webrtc.RTPCodecType][]string {
+	codecs := make(map[webrtc.RTPCodecType][]string)
+	for _, kind := range slotKinds(peer) {
+		if kind == webrtc.RTPCodecTypeAudio {
+			codecs[kind] = []string{webrtc.MimeTypeOpus}
+		} else {
+			codecs[kind] = video
+		}
+	}
+	return codecs
+}
+
+// videoMimes returns the video codecs of the live tracks in the room except
+// the uid ones, in the order of videoCodecs, VP8 if there is none.
+func (room *pmap) videoMimes(uid string) []string {
+	published := make(map[string]bool)
+	for _, p := range room.m {
+		if p.uid == uid {
+			continue
+		}
+		p.RLock()
+		for _, t := range p.tracks {
+			if t.kind == webrtc.RTPCodecTypeVideo {
+				published[strings.ToLower(t.codec.MimeType)] = true
+			}
+		}
+		p.RUnlock()
+	}
+	mimes := make([]string, 0)
+	for _, c := range videoCodecs() {
+		mime := c.MimeType
+		if published[strings.ToLower(mime)] && !slices.Contains(mimes, mime) {
+			mimes = append(mimes, mime)
+		}
+	}
+	if len(mimes) == 0 {
+		mimes = append(mimes, videoCodecs()[0].MimeType)
+	}
+	return mimes
+}
+
+// offeredMime returns the first of the video codecs offered by the remote,
+// or the first one if none is offered.
+func offeredMime(pc *webrtc.PeerConnection, video []string) string {
+	for _, mime := range video {
+		for _, t := range pc.GetTransceivers() {
+			if t.Kind() != webrtc.RTPCodecTypeVideo || t.Receiver() == nil {
+				continue
+			}
+			for _, c := range t.Receiver().GetParameters().Codecs {
+				if strings.EqualFold(c.MimeType, mime) {
+					return mime
+				}
+			}
+		}
+	}
+	return video[0]
+}
+
+// addSlots adds the missing slots of the video codecs for the first n
+// indexes, the senders are added with idle tracks and it tells whether the
+// peer should renegotiate. The slots are never removed, the ones beyond n
+// or of the codecs no longer published are kept idle.
+func (peer *Peer) addSlots(n int, video []string) (bool, error) {
+	added := false
+	for i := 0; i < n; i++ {
+		for kind, codecs := range slotCodecs(peer, video) {
+			for _, codec := range codecs {
+				if peer.slot(i, kind, codec) != nil {
+					continue
+				}
+				err := peer.addSlot(i, kind, codec)
+				if err != nil {
+					return added, err
+				}
+				added = true
+			}
+		}
+	}
+	return added, nil
+}
+
+// addSlot adds the sender of the slot with an idle track of the codec, which
+// takes the transceiver of the same kind offered by the remote if any.
+func (peer *Peer) addSlot(index int, kind webrtc.RTPCodecType, mime string) error {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+	if kind == webrtc.RTPCodecTypeVideo {
+		i := slices.IndexFunc(videoCodecs(), func(c webrtc.RTPCodecParameters) bool {
+			return strings.EqualFold(c.MimeType, mime)
+		})
+		if i < 0 {
+			return fmt.Errorf("invalid slot codec %s", mime)
+		}
+		codec = videoCodecs()[i].RTPCodecCapability
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	stream := fmt.Sprintf("slot-%d", index)
+	idle, err := webrtc.NewTrackLocalStaticRTP(codec, id.String(), stream)
+	if err != nil {
+		return err
+	}
+	sender, err := peer.pc.AddTrack(idle)
+	if err != nil {
+		return err
+	}
+	s := &Slot{id: id.String(), index: index, kind: kind, codec: codec.MimeType, rtp: sender, idle: idle}
+	peer.slots = append(peer.slots, s)
+	if kind == webrtc.RTPCodecTypeVideo {
+		go s.forwardRTCP()
+	}
+	return nil
+}
+
+// bindSlot switches the slot to the track of the publisher p, both peers
+// should be locked by the caller.
+func (peer *Peer) bindSlot(s *Slot, p *Peer, t *Track) error {
+	key := senderKey(peer.uid, t.id)
+	sel, err := t.addSelection(key, p.uid, simulcastLayerHigh)
+	if err != nil {
+		return err
+	}
+	sel.resume(s.last)
+	err = s.rtp.ReplaceTrack(sel.local)
+	if err != nil {
+		t.removeSelection(key)
+		return err
+	}
+	s.Lock()
+	s.publisher, s.track, s.sel = p, t, sel
+	s.Unlock()
+
+	peer.publishers[t.id] = &Sender{id: t.id, uid: p.uid, rtp: s.rtp, layers: sel, slot: s}
+	p.subscribers[key] = &Sender{id: peer.cid, uid: peer.uid, rtp: s.rtp, layers: sel, slot: s}
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		go p.requestKeyframe(t.layerSSRC(sel.target))
+	}
+	return nil
+}
+
+// unbindSlot switches the slot back to its idle track, the selection is
+// kept to continue the sequence numbers of the next track on the slot.
+func (peer *Peer) unbindSlot(s *Slot) error {
+	s.Lock()
+	t, sel := s.track, s.sel
+	s.publisher, s.track, s.sel = nil, nil, nil
+	s.Unlock()
+
+	if t == nil {
+		return nil
+	}
+	t.removeSelection(senderKey(peer.uid, t.id))
+	s.last = sel
+	return s.rtp.ReplaceTrack(s.idle)
+}
+
+// assignSlots forwards the n most recently active speakers to the slots of
+// the last N peer, each speaker is kept on its slot while forwarded, and
+// the new ones take the free slots. The room and the peer should be locked
+// by the caller, and it returns the subscriptions added and removed.
+func (room *pmap) assignSlots(peer *Peer) ([]map[string]string, []map[string]string) {
+	added, removed := make([]map[string]string, 0), make([]map[string]string, 0)
+	speakers := recentN(room.recent, peer.uid, peer.lastN)
+	forwarded := make(map[string]bool)
+	for _, uid := range speakers {
+		forwarded[uid] = true
+	}
+	kinds := make(map[webrtc.RTPCodecType]bool)
+	for _, kind := range slotKinds(peer) {
+		kinds[kind] = true
+	}
+
+	indexes := make(map[string]int)
+	for _, s := range peer.slots {
+		s.Lock()
+		p, t := s.publisher, s.track
+		s.Unlock()
+		if p == nil {
+			continue
+		}
+		keep := forwarded[p.uid] && room.m[p.uid] == p && s.index < peer.lastN && kinds[s.kind]
+		if keep {
+			p.RLock()
+			keep = p.tracks[t.id] == t
+			p.RUnlock()
+		}
+		if keep {
+			indexes[p.uid] = s.index
+			continue
+		}
+		old := peer.publishers[t.id]
+		if old == nil || old.slot != s {
+			old = &Sender{id: t.id, uid: p.uid, rtp: s.rtp, slot: s}
+		}
+		if _, err := room.dropSender(peer, t.id, old); err != nil {
+			logger.Printf("failed to unbind slot %s %s from peer %s with error %s\n", s.id, t.id, peer.id(), err.Error())
+		}
+		removed = append(removed, map[string]string{"uid": p.uid, "track": t.id, "slot": s.id})
+	}
+
+	used := make(map[int]bool)
+	for _, i := range indexes {
+		used[i] = true
+	}
+	for _, uid := range speakers {
+		i, ok := indexes[uid]
+		for j := 0; !ok && j < peer.lastN; j++ {
+			if !used[j] {
+				i, ok = j, true
+				used[j] = true
+			}
+		}
+		p := room.m[uid]
+		if !ok || p == nil {
+			continue
+		}
+		p.Lock()
+		for _, kind := range slotKinds(peer) {
+			for _, t := range p.sortedTracks() {
+				if t.kind != kind || peer.publishers[t.id] != nil {
+					continue
+				}
+				s := peer.slot(i, kind, t.codec.MimeType)
+				if s == nil || s.track != nil {
+					continue
+				}
+				err := peer.bindSlot(s, p, t)
+				if err != nil {
+					logger.Printf("failed to bind slot %s %s to peer %s with error %s\n", s.id, t.id, peer.id(), err.Error())
+				} else {
+					added = append(added, map[string]string{"uid": p.uid, "track": t.id, "slot": s.id})
+				}
+				break
+			}
+		}
+		p.Unlock()
+	}
+	return added, removed
+}
+
+// dropSender removes the sender of the track id from the peer, a slot is
+// switched back to idle while the other senders are removed and need a
+// renegotiation. The room and the peer should be locked by the caller.
+func (room *pmap) dropSender(peer *Peer, id string, old *Sender) (bool, error) {
+	renegotiate := false
+	if old.slot != nil {
+		err := peer.unbindSlot(old.slot)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		err := peer.pc.RemoveTrack(old.rtp)
+		if err != nil {
+			return false, err
+		}
+		renegotiate = true
+	}
+	delete(peer.publishers, id)
+	if p := room.m[old.uid]; p != nil {
+		p.Lock()
+		delete(p.subscribers, senderKey(peer.uid, id))
+		if t := p.tracks[id]; t != nil {
+			t.removeSelection(senderKey(peer.uid, id))
+		}
+		p.Unlock()
+	}
+	return renegotiate, nil
+}
+
+func (s *Slot) forwardRTCP() {
+	for {
+		pkts, _, err := s.rtp.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.Lock()
+				p, t, sel := s.publisher, s.track, s.sel
+				s.Unlock()
+				if p != nil {
+					p.requestKeyframe(t.layerSSRC(sel.layer()))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dimfeld/httptreemux/v5"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRPCCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kraken_rpc_calls_total",
+		Help: "The RPC calls by method and error code, 0 for success.",
+	}, []string{"method", "code"})
+	metricRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kraken_rpc_duration_seconds",
+		Help:    "The RPC call latency by method.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method"})
+	metricPeerConnect = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kraken_peer_connect_seconds",
+		Help:    "The time from the peer creation to the ICE and DTLS connected.",
+		Buckets: []float64{.1, .25, .5, 1, 2, 4, 8, 15, 30},
+	})
+	metricRTPPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kraken_rtp_forwarded_packets_total",
+		Help: "The RTP packets forwarded to the subscribers.",
+	})
+	metricRTPBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kraken_rtp_forwarded_bytes_total",
+		Help: "The RTP bytes forwarded to the subscribers.",
+	})
+	metricCallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kraken_callback_deliveries_total",
+		Help: "The callback event attempts by result, delivered, retried or dead.",
+	}, []string{"result"})
+)
+
+// engineCollector counts the peers and rooms on each scrape, instead of
+// the engine state which is only updated by the loop every minute.
+type engineCollector struct {
+	engine   *Engine
+	peers    *prometheus.Desc
+	rooms    *prometheus.Desc
+	draining *prometheus.Desc
+}
+
+func (c *engineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.peers
+	ch <- c.rooms
+	ch <- c.draining
+}
+
+func (c *engineCollector) Collect(ch chan<- prometheus.Metric) {
+	state := c.engine.count()
+	c.engine.rooms.RLock()
+	draining := 0.0
+	if c.engine.State.Draining {
+		draining = 1
+	}
+	c.engine.rooms.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(state.ActivePeers), "active")
+	ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(state.ListenPeers), "listen")
+	ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(state.ClosedPeers), "closed")
+	ch <- prometheus.MustNewConstMetric(c.rooms, prometheus.GaugeValue, float64(state.ActiveRooms), "active")
+	ch <- prometheus.MustNewConstMetric(c.rooms, prometheus.GaugeValue, float64(state.ClosedRooms), "closed")
+	ch <- prometheus.MustNewConstMetric(c.draining, prometheus.GaugeValue, draining)
+}
+
+func registerMetrics(router *httptreemux.TreeMux, engine *Engine) {
+	prometheus.MustRegister(metricRPCCalls, metricRPCDuration, metricPeerConnect, metricRTPPackets, metricRTPBytes, metricCallbacks)
+	prometheus.MustRegister(&engineCollector{
+		engine:   engine,
+		peers:    prometheus.NewDesc("kraken_peers", "The peers in the engine by state.", []string{"state"}, nil),
+		rooms:    prometheus.NewDesc("kraken_rooms", "The rooms in the engine by state.", []string{"state"}, nil),
+		draining: prometheus.NewDesc("kraken_draining", "Whether the engine is draining.", nil, nil),
+	})
+	handler := promhttp.Handler()
+	router.GET("/metrics", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func observeCall(method string, startAt time.Time, err error) {
+	code := 0
+	if err != nil {
+		code = -1
+		var e Error
+		if errors.As(err, &e) {
+			code = e.Code
+		}
+	}
+	metricRPCCalls.WithLabelValues(method, strconv.Itoa(code)).Inc()
+	metricRPCDuration.WithLabelValues(method).Observe(time.Since(startAt).Seconds())
+}
+
+func observeConnect(createdAt time.Time) {
+	metricPeerConnect.Observe(time.Since(createdAt).Seconds())
+}
+
+// localTrack counts the senders bound to the local track, so that each
+// packet written is counted once for each subscriber forwarded to.
+type localTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	bindings atomic.Int64
+}
+
+func newLocalTrack(c webrtc.RTPCodecCapability, id, stream string) (*localTrack, error) {
+	lt, err := webrtc.NewTrackLocalStaticRTP(c, id, stream)
+	if err != nil {
+		return nil, err
+	}
+	return &localTrack{TrackLocalStaticRTP: lt}, nil
+}
+
+func (t *localTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err == nil {
+		t.bindings.Add(1)
+	}
+	return codec, err
+}
+
+func (t *localTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	err := t.TrackLocalStaticRTP.Unbind(ctx)
+	if err == nil {
+		t.bindings.Add(-1)
+	}
+	return err
+}
+
+func writeRTP(local *localTrack, pkt *rtp.Packet) error {
+	err := local.WriteRTP(pkt)
+	if n := local.bindings.Load(); err == nil && n > 0 {
+		metricRTPPackets.Add(float64(n))
+		metricRTPBytes.Add(float64(n) * float64(pkt.MarshalSize()))
+	}
+	return err
+}
+
+// metricRenderer records the method, error code and latency of the calls
+// rendered, either rejected by the authorization or dispatched.
+type metricRenderer struct {
+	Renderer
+	method  string
+	startAt time.Time
+}
+
+func newMetricRenderer(renderer Renderer, method string) *metricRenderer {
+	if !slices.Contains(rpcMethods, method) {
+		method = "invalid"
+	}
+	return &metricRenderer{Renderer: renderer, method: method, startAt: time.Now()}
+}
+
+func (r *metricRenderer) RenderData(data any) {
+	observeCall(r.method, r.startAt, nil)
+	r.Renderer.RenderData(data)
+}
+
+func (r *metricRenderer) RenderError(err error) {
+	observeCall(r.method, r.startAt, err)
+	r.Renderer.RenderError(err)
+}
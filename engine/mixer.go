@@ -0,0 +1,398 @@
+package engine
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mixerSampleRate   = 48000
+	mixerFrameSize    = mixerSampleRate / 50
+	mixerMaxFrameSize = mixerSampleRate * 120 / 1000
+	mixerBufferLimit  = mixerFrameSize * 5
+	mixerBitrate      = 32000
+	mixerQueueSize    = 64
+	mixerTickPeriod   = 20 * time.Millisecond
+	mixerScanTicks    = 50
+	mixerTrackId      = "mixed"
+)
+
+// Mixer decodes the Opus tracks of the room, and encodes the mix every 20ms.
+// The listeners which are not sources share one mix encoded once, and each
+// source listener has its own mix without its own tracks. Each listener has
+// its own mixed track, which keeps the sequence numbers and timestamps of
+// the listener whichever mix it carries.
+type Mixer struct {
+	sync.Mutex
+	room      *pmap
+	sources   map[string]*mixSource
+	shared    *mixOutput
+	listeners map[string]*mixListener
+}
+
+type mixSource struct {
+	sync.Mutex
+	uid     string
+	track   *Track
+	queue   chan *rtp.Packet
+	decoder *opusDecoder
+	buffer  []int16
+}
+
+type mixOutput struct {
+	uid     string
+	encoder *opusEncoder
+}
+
+// mixListener is the mixed track of a listener, written with its own output
+// while the listener is a source, and with the shared one otherwise.
+type mixListener struct {
+	sender *webrtc.RTPSender
+	local  *localTrack
+	own    *mixOutput
+	seq    uint16
+	ts     uint32
+}
+
+func (r *Router) subscribeMixed(rid, uid, cid string) (*webrtc.SessionDescription, error) {
+	room := r.engine.GetRoom(rid)
+	room.Lock()
+	peer, err := room.get(uid, cid)
+	if err != nil {
+		room.Unlock()
+		return nil, err
+	}
+	if room.mixer == nil {
+		room.mixer = &Mixer{
+			room:      room,
+			sources:   make(map[string]*mixSource),
+			listeners: make(map[string]*mixListener),
+		}
+		go room.mixer.loop()
+	}
+	err = room.mixer.addOutput(peer)
+	room.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return r.subscribe(rid, uid, cid)
+}
+
+func newMixOutput(uid string) (*mixOutput, error) {
+	encoder, err := newOpusEncoder()
+	if err != nil {
+		return nil, buildError(ErrorServerMixer, err)
+	}
+	return &mixOutput{uid: uid, encoder: encoder}, nil
+}
+
+// addOutput adds the mixed track of the listener to the peer, the peer will be
+// offered the mix in place of the room audio tracks by the next subscribe,
+// and it's written with its own mix after the next scan if it's a source.
+func (m *Mixer) addOutput(peer *Peer) error {
+	m.Lock()
+	defer m.Unlock()
+
+	peer.Lock()
+	defer peer.Unlock()
+
+	if peer.mixed != nil {
+		return nil
+	}
+	if m.shared == nil {
+		shared, err := newMixOutput("")
+		if err != nil {
+			return err
+		}
+		m.shared = shared
+	}
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: mixerSampleRate, Channels: 2}
+	local, err := newLocalTrack(codec, mixerTrackId, mixerTrackId)
+	if err != nil {
+		return buildError(ErrorServerNewTrack, err)
+	}
+	sender, err := peer.pc.AddTrack(local)
+	if err != nil {
+		return buildError(ErrorServerNewTrack, err)
+	}
+	go func() {
+		for {
+			if _, _, err := sender.ReadRTCP(); err != nil {
+				return
+			}
+		}
+	}()
+	peer.mixed = sender
+	peer.renegotiate = true
+	m.listeners[peer.uid] = &mixListener{sender: sender, local: local}
+	logger.Printf("Mixer.addOutput(%s)\n", peer.id())
+	return nil
+}
+
+func (m *Mixer) loop() {
+	ticker := time.NewTicker(mixerTickPeriod)
+	defer ticker.Stop()
+
+	next := 0
+	for i := 0; ; i++ {
+		if i >= next {
+			scanned, done := m.scan()
+			if done {
+				logger.Printf("Mixer.loop(%s) done\n", m.room.id)
+				return
+			}
+			if scanned {
+				next = i + mixerScanTicks
+			}
+		}
+		m.mix()
+		<-ticker.C
+	}
+}
+
+// scan syncs the sources and listeners with the room peers, and stops the
+// mixer when no listener is left. It never waits the room or peers busy,
+// e.g. in a subscribe, and tells whether it's scanned to try the next tick.
+func (m *Mixer) scan() (bool, bool) {
+	room := m.room
+	if !room.TryLock() {
+		return false, false
+	}
+	defer room.Unlock()
+
+	m.Lock()
+	defer m.Unlock()
+
+	tracks := make(map[string]*Track)
+	uids := make(map[string]string)
+	closed := make(map[string]bool)
+	for uid, p := range room.m {
+		if !p.TryRLock() {
+			return false, false
+		}
+		if p.cid != peerTrackClosedId {
+			for id, t := range p.tracks {
+				if t.kind == webrtc.RTPCodecTypeAudio {
+					tracks[id], uids[id] = t, uid
+				}
+			}
+		} else {
+			closed[uid] = true
+		}
+		p.RUnlock()
+	}
+	for uid := range m.listeners {
+		if room.m[uid] == nil || closed[uid] {
+			delete(m.listeners, uid)
+		}
+	}
+
+	if len(m.listeners) == 0 || room.reaped {
+		for id := range m.sources {
+			m.removeSource(id)
+		}
+		if room.mixer == m {
+			room.mixer = nil
+		}
+		return true, true
+	}
+
+	for id := range m.sources {
+		if tracks[id] == nil {
+			m.removeSource(id)
+		}
+	}
+	for id, t := range tracks {
+		if m.sources[id] != nil {
+			continue
+		}
+		decoder, err := newOpusDecoder()
+		if err != nil {
+			logger.Printf("Mixer.scan(%s) decoder error %s\n", room.id, err.Error())
+			continue
+		}
+		s := &mixSource{
+			uid:     uids[id],
+			track:   t,
+			queue:   make(chan *rtp.Packet, mixerQueueSize),
+			decoder: decoder,
+		}
+		m.sources[id] = s
+		go s.decode()
+		t.Lock()
+		t.mixer = s
+		t.Unlock()
+	}
+
+	sources := make(map[string]bool)
+	for _, s := range m.sources {
+		sources[s.uid] = true
+	}
+	for uid, l := range m.listeners {
+		m.switchOutput(uid, l, sources[uid])
+	}
+	return true, false
+}
+
+// switchOutput switches the listener to its own mix if it's a source, or
+// to the shared mix otherwise.
+func (m *Mixer) switchOutput(uid string, l *mixListener, source bool) {
+	if source == (l.own != nil) {
+		return
+	}
+	if !source {
+		l.own = nil
+		return
+	}
+	own, err := newMixOutput(uid)
+	if err != nil {
+		logger.Printf("Mixer.switchOutput(%s, %s) own error %s\n", m.room.id, uid, err.Error())
+		return
+	}
+	l.own = own
+}
+
+func (m *Mixer) removeSource(id string) {
+	s := m.sources[id]
+	s.track.Lock()
+	if s.track.mixer == s {
+		s.track.mixer = nil
+	}
+	s.track.Unlock()
+	close(s.queue)
+	delete(m.sources, id)
+}
+
+func (m *Mixer) mix() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.shared == nil {
+		return
+	}
+	total := make([]int32, mixerFrameSize)
+	own := make(map[string][]int32)
+	for _, s := range m.sources {
+		frame := s.take()
+		if frame == nil {
+			continue
+		}
+		if own[s.uid] == nil {
+			own[s.uid] = make([]int32, mixerFrameSize)
+		}
+		for i, v := range frame {
+			total[i] += int32(v)
+			own[s.uid][i] += int32(v)
+		}
+	}
+
+	var shared []byte
+	encoded := false
+	for uid, l := range m.listeners {
+		if l.own != nil {
+			l.send(m.room.id, uid, l.own.encode(m.room.id, total, own[l.own.uid]))
+			continue
+		}
+		if !encoded {
+			shared, encoded = m.shared.encode(m.room.id, total, nil), true
+		}
+		l.send(m.room.id, uid, shared)
+	}
+}
+
+// send writes the encoded mix to the track of the listener with its own
+// sequence numbers and timestamps, the silent frames are skipped but their
+// timestamps are kept.
+func (l *mixListener) send(rid, uid string, payload []byte) {
+	l.ts += mixerFrameSize
+	if payload == nil {
+		return
+	}
+	l.seq += 1
+	err := writeRTP(l.local, &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: l.seq,
+			Timestamp:      l.ts,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		logger.Verbosef("Mixer.mix(%s, %s) write error %s\n", rid, uid, err.Error())
+	}
+}
+
+// encode returns the encoded mix without the own samples, or nil if it's
+// silent or fails.
+func (o *mixOutput) encode(rid string, total, own []int32) []byte {
+	pcm := make([]int16, mixerFrameSize)
+	audible := false
+	for i := range pcm {
+		v := total[i]
+		if own != nil {
+			v -= own[i]
+		}
+		pcm[i] = int16(max(math.MinInt16, min(math.MaxInt16, v)))
+		audible = audible || v != 0
+	}
+	if !audible {
+		return nil
+	}
+	payload, err := o.encoder.encode(pcm)
+	if err != nil {
+		logger.Verbosef("Mixer.mix(%s, %s) encode error %s\n", rid, o.uid, err.Error())
+		return nil
+	}
+	return payload
+}
+
+func (s *mixSource) decode() {
+	for pkt := range s.queue {
+		pcm, err := s.decoder.decode(pkt.Payload)
+		if err != nil {
+			logger.Verbosef("mixSource.decode(%s) error %s\n", s.uid, err.Error())
+			continue
+		}
+		s.Lock()
+		s.buffer = append(s.buffer, pcm...)
+		if n := len(s.buffer) - mixerBufferLimit; n > 0 {
+			s.buffer = s.buffer[n:]
+		}
+		s.Unlock()
+	}
+}
+
+// take returns the next 20ms frame of the source, or nil if it doesn't have
+// enough samples yet.
+func (s *mixSource) take() []int16 {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.buffer) < mixerFrameSize {
+		return nil
+	}
+	frame := s.buffer[:mixerFrameSize]
+	s.buffer = s.buffer[mixerFrameSize:]
+	return frame
+}
+
+// mix passes the packet to the mixer without blocking, the packet is
+// dropped if the decoder can't keep up.
+func (t *Track) mix(pkt *rtp.Packet) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.mixer == nil {
+		return
+	}
+	select {
+	case t.mixer.queue <- pkt:
+	default:
+	}
+}
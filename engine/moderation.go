@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	moderatorRole         = "moderator"
+	moderationBanDuration = 10 * time.Minute
+)
+
+// moderation keeps the mutes and bans of the room peers outside the rooms,
+// so that they survive the peers publishing again, the mutes are cleared
+// when the room is reaped and the bans when they expire.
+type moderation struct {
+	sync.Mutex
+	mutes map[string]bool
+	bans  map[string]time.Time
+}
+
+func moderationAllocate() *moderation {
+	return &moderation{
+		mutes: make(map[string]bool),
+		bans:  make(map[string]time.Time),
+	}
+}
+
+func moderationKey(rid, uid string) string {
+	return rid + ":" + uid
+}
+
+func (m *moderation) mute(rid, uid string, muted bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if muted {
+		m.mutes[moderationKey(rid, uid)] = true
+	} else {
+		delete(m.mutes, moderationKey(rid, uid))
+	}
+}
+
+func (m *moderation) muted(rid, uid string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.mutes[moderationKey(rid, uid)]
+}
+
+func (m *moderation) ban(rid, uid string, until time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	for k, t := range m.bans {
+		if time.Now().After(t) {
+			delete(m.bans, k)
+		}
+	}
+	m.bans[moderationKey(rid, uid)] = until
+}
+
+func (m *moderation) banned(rid, uid string) (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := moderationKey(rid, uid)
+	until, ok := m.bans[key]
+	if ok && time.Now().After(until) {
+		delete(m.bans, key)
+		return until, false
+	}
+	return until, ok
+}
+
+func (m *moderation) clear(rid string) {
+	m.Lock()
+	defer m.Unlock()
+
+	for k := range m.mutes {
+		if strings.HasPrefix(k, rid+":") {
+			delete(m.mutes, k)
+		}
+	}
+}
+
+// mute stops or resumes forwarding all the packets of the publisher uid to
+// the subscribers, the recording and the mixer. The video subscribers have
+// missed the keyframes while muted, so they are requested on unmute.
+func (r *Router) mute(rid, uid string, muted bool) error {
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	defer room.RUnlock()
+
+	peer := room.m[uid]
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	r.engine.moderation.mute(rid, uid, muted)
+	if peer.muted.Swap(muted) && !muted {
+		go peer.requestKeyframes(peer.videoSSRCs())
+	}
+	logger.Printf("Router.mute(%s, %s, %t)\n", rid, uid, muted)
+	return nil
+}
+
+func (r *Router) kick(rid, uid string) error {
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	peer := room.m[uid]
+	room.RUnlock()
+
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", uid, rid))
+	}
+	return peer.kick(peerCloseKick)
+}
+
+// ban kicks the peer uid if it's in the room, and rejects it from the room
+// until the duration passes.
+func (r *Router) ban(rid, uid string, duration time.Duration) error {
+	if err := validateId(rid); err != nil {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
+	}
+	if err := validateId(uid); err != nil {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid uid format %s %s", uid, err.Error()))
+	}
+	if duration <= 0 {
+		duration = r.engine.BanDuration
+	}
+	r.engine.moderation.ban(rid, uid, time.Now().Add(duration))
+	logger.Printf("Router.ban(%s, %s, %s)\n", rid, uid, duration)
+
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	peer := room.m[uid]
+	room.RUnlock()
+
+	if peer == nil || peer.cid == peerTrackClosedId {
+		return nil
+	}
+	return peer.kick(peerCloseBan)
+}
+
+func (peer *Peer) kick(reason string) error {
+	cid := peer.currentId()
+	err := peer.Close(reason)
+	peer.event(cid, "on"+reason, nil)
+	return err
+}
@@ -0,0 +1,41 @@
+//go:build cgo && (amd64 || 386 || opus)
+
+package engine
+
+import "layeh.com/gopus"
+
+// the bundled libopus is compiled on amd64 and 386, other architectures
+// need the opus tag and the system libopus found by pkg-config.
+
+type opusDecoder struct {
+	decoder *gopus.Decoder
+}
+
+type opusEncoder struct {
+	encoder *gopus.Encoder
+}
+
+func newOpusDecoder() (*opusDecoder, error) {
+	d, err := gopus.NewDecoder(mixerSampleRate, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &opusDecoder{decoder: d}, nil
+}
+
+func (d *opusDecoder) decode(payload []byte) ([]int16, error) {
+	return d.decoder.Decode(payload, mixerMaxFrameSize, false)
+}
+
+func newOpusEncoder() (*opusEncoder, error) {
+	e, err := gopus.NewEncoder(mixerSampleRate, 1, gopus.Voip)
+	if err != nil {
+		return nil, err
+	}
+	e.SetBitrate(mixerBitrate)
+	return &opusEncoder{encoder: e}, nil
+}
+
+func (e *opusEncoder) encode(pcm []int16) ([]byte, error) {
+	return e.encoder.Encode(pcm, len(pcm), 1500)
+}
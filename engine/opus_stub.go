@@ -0,0 +1,25 @@
+//go:build !cgo || !(amd64 || 386 || opus)
+
+package engine
+
+import "fmt"
+
+type opusDecoder struct{}
+
+type opusEncoder struct{}
+
+func newOpusDecoder() (*opusDecoder, error) {
+	return nil, fmt.Errorf("opus codec not available without cgo")
+}
+
+func (d *opusDecoder) decode(payload []byte) ([]int16, error) {
+	return nil, fmt.Errorf("opus codec not available without cgo")
+}
+
+func newOpusEncoder() (*opusEncoder, error) {
+	return nil, fmt.Errorf("opus codec not available without cgo")
+}
+
+func (e *opusEncoder) encode(pcm []int16) ([]byte, error) {
+	return nil, fmt.Errorf("opus codec not available without cgo")
+}
@@ -1,16 +1,17 @@
 package engine
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/gofrs/uuid/v5"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 )
@@ -19,19 +20,33 @@ const (
 	peerTrackClosedId          = "CLOSED"
 	peerTrackConnectionTimeout = 60 * time.Second
 	peerTrackReadTimeout       = 60 * time.Second
+	peerTracksLimit            = 8
 )
 
-var clbkClient *http.Client
+var errTrackReadTimeout = fmt.Errorf("peer track read timeout")
 
-func init() {
-	clbkClient = &http.Client{
-		Timeout: 30 * time.Second,
-	}
+type Sender struct {
+	id     string
+	uid    string
+	rtp    *webrtc.RTPSender
+	layers *Selection
+	slot   *Slot
 }
 
-type Sender struct {
-	id  string
-	rtp *webrtc.RTPSender
+type Track struct {
+	sync.RWMutex
+	id         string
+	remote     string
+	stream     string
+	kind       webrtc.RTPCodecType
+	codec      webrtc.RTPCodecCapability
+	ssrc       webrtc.SSRC
+	local      *localTrack
+	layers     map[string]webrtc.SSRC
+	selections map[string]*Selection
+	tap        *RecordedFile
+	mixer      *mixSource
+	levelExt   uint8
 }
 
 type Peer struct {
@@ -40,23 +55,36 @@ type Peer struct {
 	uid         string
 	cid         string
 	callback    string
+	notify      func(rid string)
+	closed      func(peer *Peer, cid, reason string)
+	webhook     *Webhook
+	trickle     *iceTrickle
 	pc          *webrtc.PeerConnection
-	track       *webrtc.TrackLocalStaticRTP
+	mixed       *webrtc.RTPSender
+	getter      stats.Getter
+	tracks      map[string]*Track
 	publishers  map[string]*Sender
 	subscribers map[string]*Sender
-	queue       chan *rtp.Packet
+	slots       []*Slot
 	connected   chan bool
+	level       audioLevel
+	renegotiate bool
+	lastN       int
+	listener    bool
+	muted       atomic.Bool
+	closedAt    time.Time
 }
 
-func BuildPeer(rid, uid string, pc *webrtc.PeerConnection, callback string) *Peer {
+func BuildPeer(rid, uid string, pc *webrtc.PeerConnection, getter stats.Getter, callback string, notify func(rid string)) *Peer {
 	cid, err := uuid.NewV4()
 	if err != nil {
 		panic(err)
 	}
-	peer := &Peer{rid: rid, uid: uid, cid: cid.String(), pc: pc}
+	peer := &Peer{rid: rid, uid: uid, cid: cid.String(), pc: pc, getter: getter}
 	peer.callback = callback
+	peer.notify = notify
 	peer.connected = make(chan bool, 1)
-	peer.queue = make(chan *rtp.Packet, 8)
+	peer.tracks = make(map[string]*Track)
 	peer.publishers = make(map[string]*Sender)
 	peer.subscribers = make(map[string]*Sender)
 	peer.handle()
@@ -67,8 +95,15 @@ func (p *Peer) id() string {
 	return fmt.Sprintf("%s:%s:%s", p.rid, p.uid, p.cid)
 }
 
-func (p *Peer) Close() error {
-	logger.Printf("PeerClose(%s) now\n", p.id())
+// currentId returns the cid of the peer, which may be closed concurrently.
+func (p *Peer) currentId() string {
+	p.RLock()
+	defer p.RUnlock()
+	return p.cid
+}
+
+func (p *Peer) Close(reason string) error {
+	logger.Printf("PeerClose(%s, %s) now\n", p.id(), reason)
 	p.Lock()
 	defer p.Unlock()
 
@@ -77,14 +112,29 @@ func (p *Peer) Close() error {
 		return nil
 	}
 
-	p.track = nil
+	cid := p.cid
+	p.tracks = make(map[string]*Track)
 	p.cid = peerTrackClosedId
+	p.closedAt = time.Now()
 	err := p.pc.Close()
+	p.notify(p.rid)
+	if p.closed != nil {
+		if p.webhook != nil {
+			p.webhook.hold()
+		}
+		go func() {
+			p.closed(p, cid, reason)
+			if p.webhook != nil {
+				p.webhook.release()
+			}
+		}()
+	}
 	logger.Printf("PeerClose(%s) with %v\n", p.id(), err)
 	return err
 }
 
 func (peer *Peer) handle() {
+	createdAt := time.Now()
 	go func() {
 		timer := time.NewTimer(peerTrackConnectionTimeout)
 		defer timer.Stop()
@@ -93,92 +143,307 @@ func (peer *Peer) handle() {
 		case <-peer.connected:
 		case <-timer.C:
 			logger.Printf("HandlePeer(%s) OnTrackTimeout()\n", peer.id())
-			peer.Close()
+			peer.Close(peerCloseTimeout)
 		}
 	}()
 
 	peer.pc.OnSignalingStateChange(func(state webrtc.SignalingState) {
 		logger.Printf("HandlePeer(%s) OnSignalingStateChange(%s)\n", peer.id(), state)
 	})
+	var observed atomic.Bool
 	peer.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		logger.Printf("HandlePeer(%s) OnConnectionStateChange(%s)\n", peer.id(), state)
+		if state == webrtc.PeerConnectionStateConnected && observed.CompareAndSwap(false, true) {
+			observeConnect(createdAt)
+		}
 	})
 	peer.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		logger.Printf("HandlePeer(%s) OnICEConnectionStateChange(%s)\n", peer.id(), state)
+		switch state {
+		case webrtc.ICEConnectionStateConnected:
+			peer.event(peer.currentId(), "onconnected", nil)
+		case webrtc.ICEConnectionStateDisconnected:
+			peer.event(peer.currentId(), "ondisconnected", nil)
+		case webrtc.ICEConnectionStateFailed:
+			peer.event(peer.currentId(), "onfailed", nil)
+		}
 	})
 	peer.pc.OnTrack(func(rt *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		logger.Printf("HandlePeer(%s) OnTrack(%d, %d)\n", peer.id(), rt.PayloadType(), rt.SSRC())
-		added, err := peer.addTrackFromRemote(rt)
+		track, first, err := peer.addTrackFromRemote(rt, receiver)
 		if err != nil {
 			panic(err)
 		}
-		if !added {
+		if track == nil {
 			return
 		}
-		peer.connected <- true
+		if first {
+			peer.connected <- true
+			peer.callbackOnTrack()
+		}
 
-		err = peer.callbackOnTrack()
-		if err != nil {
-			logger.Printf("HandlePeer(%s) OnTrack(%d, %d) callback error %v\n", peer.id(), rt.PayloadType(), rt.SSRC(), err)
-		} else {
-			err = peer.copyTrack(rt, peer.track)
-			logger.Printf("HandlePeer(%s) OnTrack(%d, %d) end with %v\n", peer.id(), rt.PayloadType(), rt.SSRC(), err)
+		peer.notify(peer.rid)
+		err = peer.copyTrack(rt, track)
+		logger.Printf("HandlePeer(%s) OnTrack(%d, %d, %s) end with %v\n", peer.id(), rt.PayloadType(), rt.SSRC(), rt.RID(), err)
+		if rt.RID() != "" {
+			ssrcs, left := track.removeLayer(rt.RID())
+			peer.requestKeyframes(ssrcs)
+			if left > 0 {
+				return
+			}
+		}
+		if peer.removeTrack(track.id) == 0 {
+			peer.Close(peerCloseReadTimeout)
 		}
-		peer.Close()
 	})
 }
 
-func (peer *Peer) addTrackFromRemote(rt *webrtc.TrackRemote) (bool, error) {
+func (peer *Peer) addTrackFromRemote(rt *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) (*Track, bool, error) {
 	peer.Lock()
 	defer peer.Unlock()
 
 	if peer.cid == peerTrackClosedId {
-		return false, nil
+		return nil, false, nil
+	}
+
+	rid := rt.RID()
+	if rid != "" {
+		if rt.Kind() != webrtc.RTPCodecTypeVideo || !validateLayer(rid) {
+			return nil, false, nil
+		}
+		for _, t := range peer.tracks {
+			if t.remote != rt.ID() || !t.simulcast() {
+				continue
+			}
+			ssrcs, ok := t.addLayer(rid, rt.SSRC())
+			if !ok {
+				return nil, false, nil
+			}
+			go peer.requestKeyframes(ssrcs)
+			return t, false, nil
+		}
 	}
 
 	rpt := rt.PayloadType()
-	if peer.track != nil || (rpt != 111 && rpt != 109) {
-		return false, nil
+	if len(peer.tracks) >= peerTracksLimit {
+		return nil, false, nil
 	}
-	lt, err := webrtc.NewTrackLocalStaticRTP(rt.Codec().RTPCodecCapability, peer.cid, peer.uid)
+	if rt.Kind() == webrtc.RTPCodecTypeAudio && rpt != 111 && rpt != 109 {
+		return nil, false, nil
+	}
+	id, err := uuid.NewV4()
 	if err != nil {
-		return false, err
+		return nil, false, err
+	}
+	track := &Track{
+		id:         id.String(),
+		remote:     rt.ID(),
+		stream:     rt.StreamID(),
+		kind:       rt.Kind(),
+		codec:      rt.Codec().RTPCodecCapability,
+		layers:     make(map[string]webrtc.SSRC),
+		selections: make(map[string]*Selection),
+	}
+	if rt.Kind() == webrtc.RTPCodecTypeAudio {
+		track.levelExt = audioLevelExtensionId(receiver)
+	}
+	if rid != "" {
+		track.layers[rid] = rt.SSRC()
+	} else {
+		lt, err := newLocalTrack(track.codec, track.id, peer.uid)
+		if err != nil {
+			return nil, false, err
+		}
+		track.ssrc = rt.SSRC()
+		track.local = lt
 	}
-	peer.track = lt
-	return true, nil
+	first := len(peer.tracks) == 0
+	peer.tracks[track.id] = track
+	return track, first, nil
 }
 
-func (peer *Peer) callbackOnTrack() error {
-	if peer.callback == "" {
-		return nil
+func (peer *Peer) removeTrack(id string) int {
+	peer.Lock()
+	defer peer.Unlock()
+
+	delete(peer.tracks, id)
+	peer.notify(peer.rid)
+	return len(peer.tracks)
+}
+
+// unlink drops all the senders from or to the reaped peers, the peer
+// should be locked by the caller.
+func (peer *Peer) unlink(reaped map[string]bool) {
+	for key, s := range peer.subscribers {
+		if reaped[s.uid] {
+			delete(peer.subscribers, key)
+		}
+	}
+	for _, t := range peer.tracks {
+		for uid := range reaped {
+			t.removeSelection(senderKey(uid, t.id))
+		}
+	}
+	for id, s := range peer.publishers {
+		if !reaped[s.uid] {
+			continue
+		}
+		if s.slot != nil {
+			err := peer.unbindSlot(s.slot)
+			if err != nil {
+				logger.Printf("failed to unbind slot %s %s from peer %s with error %s\n", s.slot.id, id, peer.id(), err.Error())
+			}
+		} else if peer.cid != peerTrackClosedId {
+			err := peer.pc.RemoveTrack(s.rtp)
+			if err != nil {
+				logger.Printf("failed to remove sender %s %s from peer %s with error %s\n", s.uid, id, peer.id(), err.Error())
+			}
+			peer.renegotiate = true
+		}
+		delete(peer.publishers, id)
+	}
+	if peer.renegotiate {
+		peer.notify(peer.rid)
 	}
+}
 
-	body, _ := json.Marshal(map[string]string{
-		"rid":    peer.rid,
-		"uid":    peer.uid,
-		"cid":    peer.cid,
-		"action": "ontrack",
-	})
-	req, err := http.NewRequest("POST", peer.callback, bytes.NewReader(body))
+func (peer *Peer) sortedTracks() []*Track {
+	tracks := make([]*Track, 0, len(peer.tracks))
+	for _, t := range peer.tracks {
+		tracks = append(tracks, t)
+	}
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].id < tracks[j].id })
+	return tracks
+}
+
+// subscribeTrack adds the track of the publisher p to the peer, both peers
+// should be locked by the caller.
+func (peer *Peer) subscribeTrack(p *Peer, t *Track) error {
+	key := senderKey(peer.uid, t.id)
+	var sel *Selection
+	local := webrtc.TrackLocal(t.local)
+	if t.simulcast() {
+		s, err := t.addSelection(key, p.uid, simulcastLayerHigh)
+		if err != nil {
+			return err
+		}
+		sel, local = s, s.local
+	}
+	sender, err := peer.pc.AddTrack(local)
 	if err != nil {
+		if sel != nil {
+			t.removeSelection(key)
+		}
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := clbkClient.Do(req)
+	if sid := sender.Track().ID(); sid != t.id {
+		panic(fmt.Errorf("malformed peer and track id %s %s", t.id, sid))
+	}
+	peer.publishers[t.id] = &Sender{id: t.id, uid: p.uid, rtp: sender, layers: sel}
+	p.subscribers[key] = &Sender{id: peer.cid, uid: peer.uid, rtp: sender, layers: sel}
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		go p.forwardRTCP(sender, t, sel)
+	}
+	return nil
+}
+
+func (peer *Peer) forwardRTCP(sender *webrtc.RTPSender, track *Track, sel *Selection) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if sel == nil {
+					peer.requestKeyframe(track.ssrc)
+					continue
+				}
+				peer.requestKeyframe(track.layerSSRC(sel.layer()))
+			}
+		}
+	}
+}
+
+// videoSSRCs returns the SSRCs of all the video tracks and their layers.
+func (peer *Peer) videoSSRCs() []webrtc.SSRC {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	var ssrcs []webrtc.SSRC
+	for _, t := range peer.tracks {
+		if t.kind != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		t.RLock()
+		if len(t.layers) == 0 {
+			ssrcs = append(ssrcs, t.ssrc)
+		}
+		for _, ssrc := range t.layers {
+			ssrcs = append(ssrcs, ssrc)
+		}
+		t.RUnlock()
+	}
+	return ssrcs
+}
+
+func (peer *Peer) requestKeyframes(ssrcs []webrtc.SSRC) {
+	for _, ssrc := range ssrcs {
+		peer.requestKeyframe(ssrc)
+	}
+}
+
+func (peer *Peer) requestKeyframe(ssrc webrtc.SSRC) {
+	peer.RLock()
+	defer peer.RUnlock()
+
+	if peer.cid == peerTrackClosedId {
+		return
+	}
+	pli := &rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}
+	err := peer.pc.WriteRTCP([]rtcp.Packet{pli})
 	if err != nil {
-		return err
+		logger.Verbosef("requestKeyframe(%s) error %s\n", peer.id(), err.Error())
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("status: %d", resp.StatusCode)
+// callbackOnTrack queues the ontrack event while the tracks are forwarded,
+// and closes the peer if it's dead at last, unless the policy is ignore.
+func (peer *Peer) callbackOnTrack() {
+	if peer.callback == "" || peer.webhook == nil {
+		return
 	}
-	return nil
+
+	data := map[string]any{
+		"rid":    peer.rid,
+		"uid":    peer.uid,
+		"cid":    peer.currentId(),
+		"action": "ontrack",
+	}
+	if peer.webhook.onTrack == webhookOnTrackIgnore {
+		peer.webhook.enqueue(peer.callback, data)
+		return
+	}
+	peer.webhook.enqueueWithDone(peer.callback, data, func(err error) {
+		if err == nil {
+			return
+		}
+		logger.Printf("callbackOnTrack(%s) error %v\n", peer.id(), err)
+		peer.Close(peerCloseCallback)
+	})
 }
 
-func (peer *Peer) copyTrack(src *webrtc.TrackRemote, dst *webrtc.TrackLocalStaticRTP) error {
+// copyTrack reads the remote track in a goroutine and forwards the packets
+// until an error or timeout, the reader quits once the forwarding ends. A
+// simulcast layer timed out is removed while the others are left, and it's
+// added back to the track once its packets come back.
+func (peer *Peer) copyTrack(src *webrtc.TrackRemote, dst *Track) error {
+	queue := make(chan *rtp.Packet, 8)
+	done := make(chan struct{})
+	defer close(done)
 	go func() error {
-		defer close(peer.queue)
+		defer close(queue)
 
 		for {
 			pkt, _, err := src.ReadRTP()
@@ -190,33 +455,60 @@ func (peer *Peer) copyTrack(src *webrtc.TrackRemote, dst *webrtc.TrackLocalStati
 				logger.Verbosef("copyTrack(%s) error %s\n", peer.id(), err.Error())
 				return err
 			}
-			peer.queue <- pkt
+			select {
+			case queue <- pkt:
+			case <-done:
+				return nil
+			}
 		}
 	}()
 
 	for {
-		err := peer.consumeQueue(dst)
-		if err != nil {
+		err := peer.consumeQueue(queue, dst, src.RID())
+		if err == nil {
+			continue
+		}
+		if src.RID() == "" || err != errTrackReadTimeout {
 			return err
 		}
+		ssrcs, left := dst.removeLayer(src.RID())
+		if left == 0 {
+			return err
+		}
+		peer.requestKeyframes(ssrcs)
+		logger.Verbosef("copyTrack(%s, %s) layer paused\n", peer.id(), src.RID())
+		if _, ok := <-queue; !ok {
+			return fmt.Errorf("peer queue closed")
+		}
+		ssrcs, _ = dst.addLayer(src.RID(), src.SSRC())
+		peer.requestKeyframes(ssrcs)
+		logger.Verbosef("copyTrack(%s, %s) layer resumed\n", peer.id(), src.RID())
 	}
 }
 
-func (peer *Peer) consumeQueue(dst *webrtc.TrackLocalStaticRTP) error {
+func (peer *Peer) consumeQueue(queue chan *rtp.Packet, dst *Track, layer string) error {
 	timer := time.NewTimer(peerTrackReadTimeout)
 	defer timer.Stop()
 
 	select {
-	case pkt, ok := <-peer.queue:
+	case pkt, ok := <-queue:
 		if !ok {
 			return fmt.Errorf("peer queue closed")
 		}
-		err := dst.WriteRTP(pkt)
+		if peer.muted.Load() {
+			return nil
+		}
+		if dst.levelExt != 0 {
+			peer.updateAudioLevel(pkt, dst.levelExt)
+		}
+		dst.record(pkt)
+		dst.mix(pkt)
+		err := dst.write(layer, pkt)
 		if err != nil {
 			return fmt.Errorf("peer track write %v", err)
 		}
 	case <-timer.C:
-		return fmt.Errorf("peer track read timeout")
+		return errTrackReadTimeout
 	}
 
 	return nil
@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+const (
+	recordLoopPeriod = 1 * time.Second
+	recordQueueSize  = 256
+)
+
+// Recording writes each audio track of the room to an Ogg/Opus file, the
+// tracks are tapped with a buffered queue which drops packets when full,
+// so that a slow disk never blocks the forwarding to subscribers.
+type Recording struct {
+	sync.Mutex
+	Room      string          `json:"rid"`
+	Dir       string          `json:"dir"`
+	StartedAt time.Time       `json:"started_at"`
+	StoppedAt time.Time       `json:"stopped_at"`
+	Files     []*RecordedFile `json:"files"`
+
+	room  *pmap
+	files map[string]*RecordedFile
+	done  chan struct{}
+	once  sync.Once
+}
+
+// RecordedFile offset is the seconds from the recording start to the first
+// packet of the file, to align the files of the room.
+type RecordedFile struct {
+	Uid       string    `json:"uid"`
+	Track     string    `json:"track"`
+	File      string    `json:"file"`
+	Offset    float64   `json:"offset"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Dropped   int64     `json:"dropped"`
+
+	track  *Track
+	queue  chan *rtp.Packet
+	writer *oggwriter.OggWriter
+	closed chan struct{}
+}
+
+func (r *Router) recordStart(rid string, dir string) (*Recording, error) {
+	if err := validateId(rid); err != nil {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
+	}
+	if dir == "" {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("recording not configured"))
+	}
+	room := r.engine.LockRoom(rid)
+	defer room.Unlock()
+
+	if room.recording != nil {
+		return room.recording.snapshot(), nil
+	}
+	now := time.Now()
+	rec := &Recording{
+		Room:      rid,
+		Dir:       filepath.Join(dir, fmt.Sprintf("%s-%d", rid, now.Unix())),
+		StartedAt: now,
+		room:      room,
+		files:     make(map[string]*RecordedFile),
+		done:      make(chan struct{}),
+	}
+	err := os.MkdirAll(rec.Dir, 0700)
+	if err != nil {
+		return nil, buildError(ErrorServerRecord, err)
+	}
+	room.recording = rec
+	go rec.loop()
+	logger.Printf("Router.recordStart(%s) %s\n", rid, rec.Dir)
+	return rec.snapshot(), nil
+}
+
+func (r *Router) recordStop(rid string) (*Recording, error) {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return nil, buildError(ErrorRecordingNotFound, fmt.Errorf("room %s not recording", rid))
+	}
+	room.Lock()
+	rec := room.recording
+	room.recording = nil
+	room.Unlock()
+
+	if rec == nil {
+		return nil, buildError(ErrorRecordingNotFound, fmt.Errorf("room %s not recording", rid))
+	}
+	rec.stop()
+	return rec.snapshot(), nil
+}
+
+// stopRecordings finalizes the files of all the recording rooms, e.g. when
+// the engine shuts down.
+func (engine *Engine) stopRecordings() {
+	var recs []*Recording
+	for _, pm := range engine.snapshot() {
+		pm.Lock()
+		if pm.recording != nil {
+			recs = append(recs, pm.recording)
+			pm.recording = nil
+		}
+		pm.Unlock()
+	}
+
+	for _, rec := range recs {
+		rec.stop()
+	}
+}
+
+func (rec *Recording) loop() {
+	ticker := time.NewTicker(recordLoopPeriod)
+	defer ticker.Stop()
+
+	for {
+		if rec.tap() {
+			rec.room.Lock()
+			if rec.room.recording == rec {
+				rec.room.recording = nil
+			}
+			rec.room.Unlock()
+			rec.stop()
+			return
+		}
+		select {
+		case <-rec.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tap adds the audio tracks not yet recorded, including the tracks of the
+// peers joined after the recording start, it tells whether the room has
+// been reaped.
+func (rec *Recording) tap() bool {
+	var tracks []*Track
+	var uids []string
+	rec.room.RLock()
+	reaped := rec.room.reaped
+	for uid, p := range rec.room.m {
+		p.RLock()
+		if p.cid != peerTrackClosedId {
+			for _, t := range p.tracks {
+				if t.kind == webrtc.RTPCodecTypeAudio {
+					tracks = append(tracks, t)
+					uids = append(uids, uid)
+				}
+			}
+		}
+		p.RUnlock()
+	}
+	rec.room.RUnlock()
+	if reaped {
+		return true
+	}
+
+	rec.Lock()
+	defer rec.Unlock()
+
+	select {
+	case <-rec.done:
+		return false
+	default:
+	}
+	added := false
+	for i, t := range tracks {
+		if rec.files[t.id] != nil {
+			continue
+		}
+		name := fmt.Sprintf("%s-%s.ogg", uids[i], t.id)
+		writer, err := oggwriter.New(filepath.Join(rec.Dir, name), t.codec.ClockRate, t.codec.Channels)
+		if err != nil {
+			logger.Printf("Recording.tap(%s, %s) error %s\n", rec.Room, name, err.Error())
+			continue
+		}
+		f := &RecordedFile{
+			Uid:    uids[i],
+			Track:  t.id,
+			File:   name,
+			track:  t,
+			queue:  make(chan *rtp.Packet, recordQueueSize),
+			writer: writer,
+			closed: make(chan struct{}),
+		}
+		rec.files[t.id] = f
+		rec.Files = append(rec.Files, f)
+		go rec.write(f)
+		t.Lock()
+		t.tap = f
+		t.Unlock()
+		added = true
+	}
+	if added {
+		rec.writeManifest()
+	}
+	return false
+}
+
+func (rec *Recording) write(f *RecordedFile) {
+	defer close(f.closed)
+	for pkt := range f.queue {
+		now := time.Now()
+		rec.Lock()
+		if f.StartedAt.IsZero() {
+			f.StartedAt = now
+			f.Offset = now.Sub(rec.StartedAt).Seconds()
+		}
+		f.EndedAt = now
+		rec.Unlock()
+		err := f.writer.WriteRTP(pkt)
+		if err != nil {
+			logger.Verbosef("Recording.write(%s, %s) error %s\n", rec.Room, f.File, err.Error())
+		}
+	}
+	f.writer.Close()
+}
+
+func (rec *Recording) stop() {
+	rec.once.Do(rec.finish)
+}
+
+func (rec *Recording) finish() {
+	rec.Lock()
+	close(rec.done)
+	files := make([]*RecordedFile, 0, len(rec.files))
+	for _, f := range rec.files {
+		files = append(files, f)
+	}
+	rec.Unlock()
+
+	for _, f := range files {
+		f.track.Lock()
+		if f.track.tap == f {
+			f.track.tap = nil
+		}
+		f.track.Unlock()
+		close(f.queue)
+		<-f.closed
+	}
+
+	rec.Lock()
+	defer rec.Unlock()
+	rec.StoppedAt = time.Now()
+	rec.writeManifest()
+	logger.Printf("Recording.stop(%s) %d files\n", rec.Room, len(files))
+}
+
+func (rec *Recording) writeManifest() {
+	data, _ := json.MarshalIndent(rec.copy(), "", "  ")
+	err := os.WriteFile(filepath.Join(rec.Dir, "manifest.json"), data, 0600)
+	if err != nil {
+		logger.Printf("Recording.writeManifest(%s) error %s\n", rec.Room, err.Error())
+	}
+}
+
+func (rec *Recording) snapshot() *Recording {
+	rec.Lock()
+	defer rec.Unlock()
+
+	return rec.copy()
+}
+
+func (rec *Recording) copy() *Recording {
+	c := &Recording{Room: rec.Room, Dir: rec.Dir, StartedAt: rec.StartedAt, StoppedAt: rec.StoppedAt}
+	c.Files = make([]*RecordedFile, 0, len(rec.Files))
+	for _, f := range rec.Files {
+		c.Files = append(c.Files, &RecordedFile{
+			Uid:       f.Uid,
+			Track:     f.Track,
+			File:      f.File,
+			Offset:    f.Offset,
+			StartedAt: f.StartedAt,
+			EndedAt:   f.EndedAt,
+			Dropped:   atomic.LoadInt64(&f.Dropped),
+		})
+	}
+	sort.SliceStable(c.Files, func(i, j int) bool { return c.Files[i].Offset < c.Files[j].Offset })
+	return c
+}
+
+// record passes the packet to the recording without blocking, the packet
+// is dropped if the recording can't keep up.
+func (t *Track) record(pkt *rtp.Packet) {
+	t.RLock()
+	defer t.RUnlock()
+
+	if t.tap == nil {
+		return
+	}
+	select {
+	case t.tap.queue <- pkt:
+	default:
+		atomic.AddInt64(&t.tap.Dropped, 1)
+	}
+}
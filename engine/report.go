@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gofrs/uuid/v5"
+)
+
+const (
+	engineReportPeriod = 10 * time.Second
+
+	MonitorTimestampHeader = "X-Kraken-Timestamp"
+	MonitorSignatureHeader = "X-Kraken-Signature"
+	MonitorSignatureWindow = 5 * time.Minute
+)
+
+var reportClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// ReportLoop registers the engine to the monitor, and sends the engine
+// state periodically as the heartbeat, it registers again whenever the
+// monitor doesn't recognize the engine, e.g. after a monitor restart. The
+// calls are signed by the monitor secret as the callback events.
+func (engine *Engine) ReportLoop(conf *Configuration) {
+	id, url := conf.Monitor.Id, conf.Monitor.URL
+	if id == "" {
+		id = fmt.Sprintf("%s:%d", engine.IP, conf.RPC.Port)
+	}
+	if url == "" {
+		url = fmt.Sprintf("http://%s:%d", engine.IP, conf.RPC.Port)
+	}
+
+	registered := false
+	for {
+		var err error
+		if !registered {
+			err = callMonitor(conf.Monitor.Endpoint, conf.Monitor.Secret, "register", []any{id, url})
+			registered = err == nil
+		} else {
+			state := engine.current()
+			err = callMonitor(conf.Monitor.Endpoint, conf.Monitor.Secret, "heartbeat", []any{id, state})
+			registered = err == nil
+		}
+		if err != nil {
+			logger.Printf("Engine.ReportLoop(%s, %s) error %s\n", id, conf.Monitor.Endpoint, err.Error())
+		}
+		time.Sleep(engineReportPeriod)
+	}
+}
+
+func callMonitor(endpoint, secret, method string, params []any) error {
+	id, _ := uuid.NewV4()
+	body, _ := json.Marshal(map[string]any{"id": id.String(), "method": method, "params": params})
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MonitorTimestampHeader, ts)
+	req.Header.Set(MonitorSignatureHeader, "sha256="+signBody(secret, ts, body))
+	resp, err := reportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Error any `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return err
+	}
+	if res.Error != nil {
+		return fmt.Errorf("monitor %s error %v", method, res.Error)
+	}
+	return nil
+}
+
+// VerifySignature checks the signature of the body signed by the secret at
+// the timestamp, which should be within the window from now.
+func VerifySignature(secret, ts, signature string, body []byte) error {
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", ts)
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > MonitorSignatureWindow || d < -MonitorSignatureWindow {
+		return fmt.Errorf("expired timestamp %s", ts)
+	}
+	expected := "sha256=" + signBody(secret, ts, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
@@ -4,21 +4,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
 	"time"
 
 	"github.com/MixinNetwork/mixin/logger"
 	"github.com/gofrs/uuid/v5"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/sdp/v2"
 	"github.com/pion/webrtc/v3"
 )
 
 type Router struct {
-	engine *Engine
+	engine  *Engine
+	signals *signaler
 }
 
 func NewRouter(engine *Engine) *Router {
-	return &Router{engine: engine}
+	r := &Router{engine: engine, signals: newSignaler()}
+	engine.notify = r.signal
+	return r
 }
 
 func (r *Router) info() (any, error) {
@@ -39,21 +44,73 @@ func (r *Router) list(rid string) ([]map[string]any, error) {
 		if cid.String() == uuid.Nil.String() {
 			continue
 		}
+		p.RLock()
+		tracks := make([]map[string]any, 0)
+		for _, t := range p.tracks {
+			t.RLock()
+			layers := make([]string, 0)
+			for _, l := range simulcastLayers {
+				if t.layers[l] != 0 {
+					layers = append(layers, l)
+				}
+			}
+			t.RUnlock()
+			tracks = append(tracks, map[string]any{
+				"id":     t.id,
+				"kind":   t.kind.String(),
+				"stream": t.stream,
+				"codec":  t.codec.MimeType,
+				"layers": layers,
+			})
+		}
+		p.RUnlock()
+		sort.Slice(tracks, func(i, j int) bool { return tracks[i]["id"].(string) < tracks[j]["id"].(string) })
 		peers = append(peers, map[string]any{
-			"id":    p.uid,
-			"track": cid.String(),
+			"id":       p.uid,
+			"track":    cid.String(),
+			"tracks":   tracks,
+			"listener": p.listener,
+			"muted":    p.muted.Load(),
 		})
 	}
 	return peers, nil
 }
 
-func (r *Router) create(rid, uid, callback string, offer webrtc.SessionDescription) (*Peer, error) {
+func (r *Router) speakers(rid string) ([]*Speaker, string, error) {
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	defer room.RUnlock()
+
+	return room.speakers, room.dominant, nil
+}
+
+func (r *Router) stats(rid, uid, cid string) (map[string]any, error) {
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	peer, err := room.get(uid, cid)
+	room.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return peer.stats(), nil
+}
+
+func (r *Router) newPeerConnection() (*webrtc.PeerConnection, stats.Getter, error) {
 	se := webrtc.SettingEngine{}
 	se.SetLite(true)
 	se.SetInterfaceFilter(func(in string) bool { return in == r.engine.Interface })
 	se.SetNAT1To1IPs([]string{r.engine.IP}, webrtc.ICECandidateTypeHost)
 	se.SetICETimeouts(10*time.Second, 30*time.Second, 2*time.Second)
-	se.SetEphemeralUDPPortRange(r.engine.PortMin, r.engine.PortMax)
+	if r.engine.udpMux != nil {
+		se.SetICEUDPMux(r.engine.udpMux)
+	} else {
+		se.SetEphemeralUDPPortRange(r.engine.PortMin, r.engine.PortMax)
+	}
+	if r.engine.tcpMux != nil {
+		se.SetICETCPMux(r.engine.tcpMux)
+		se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeTCP4})
+	}
 	se.SetDTLSInsecureSkipHelloVerify(true)
 	se.SetReceiveMTU(8192)
 
@@ -68,12 +125,28 @@ func (r *Router) create(rid, uid, callback string, offer webrtc.SessionDescripti
 	}
 	me.RegisterCodec(opusChrome, webrtc.RTPCodecTypeAudio)
 	me.RegisterCodec(opusFirefox, webrtc.RTPCodecTypeAudio)
+	for _, vc := range videoCodecs() {
+		me.RegisterCodec(vc, webrtc.RTPCodecTypeVideo)
+	}
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo)
+	}
+	me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: audioLevelURI}, webrtc.RTPCodecTypeAudio)
 
 	ir := &interceptor.Registry{}
 	err := webrtc.RegisterDefaultInterceptors(me, ir)
 	if err != nil {
 		panic(err)
 	}
+	var getter stats.Getter
+	sf, err := stats.NewInterceptor()
+	if err != nil {
+		panic(err)
+	}
+	sf.OnNewPeerConnection(func(_ string, g stats.Getter) {
+		getter = g
+	})
+	ir.Add(sf)
 
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(me), webrtc.WithSettingEngine(se), webrtc.WithInterceptorRegistry(ir))
 
@@ -83,7 +156,19 @@ func (r *Router) create(rid, uid, callback string, offer webrtc.SessionDescripti
 	}
 	pc, err := api.NewPeerConnection(pcConfig)
 	if err != nil {
-		return nil, buildError(ErrorServerNewPeerConnection, err)
+		return nil, nil, buildError(ErrorServerNewPeerConnection, err)
+	}
+	return pc, getter, nil
+}
+
+func (r *Router) create(rid, uid, callback string, offer webrtc.SessionDescription, listen, trickle bool) (*Peer, error) {
+	pc, getter, err := r.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	var candidates *iceTrickle
+	if trickle {
+		candidates = r.trickleCandidates(pc, rid, uid)
 	}
 
 	err = pc.SetRemoteDescription(offer)
@@ -102,13 +187,38 @@ func (r *Router) create(rid, uid, callback string, offer webrtc.SessionDescripti
 		pc.Close()
 		return nil, buildError(ErrorServerSetLocalAnswer, err)
 	}
-	<-gatherComplete
+	if candidates == nil {
+		<-gatherComplete
+	}
 
-	peer := BuildPeer(rid, uid, pc, callback)
+	peer := BuildPeer(rid, uid, pc, getter, callback, r.signal)
+	if candidates != nil {
+		candidates.bind(peer.cid)
+	}
+	peer.trickle = candidates
+	peer.closed = r.closed
+	peer.webhook = r.engine.webhook
+	peer.lastN = r.engine.LastN
+	if listen {
+		peer.listener = true
+		peer.connected <- true
+	}
 	return peer, nil
 }
 
-func (r *Router) publish(rid, uid string, jsep string, limit int, callback string) (string, *webrtc.SessionDescription, error) {
+func (r *Router) publish(rid, uid string, jsep string, limit int, callback string, trickle bool) (string, *webrtc.SessionDescription, error) {
+	return r.connect(rid, uid, jsep, limit, callback, false, trickle)
+}
+
+// join creates a listen only peer, which is connected without any inbound
+// track, and receives the room tracks by subscribe and answer.
+func (r *Router) join(rid, uid string, jsep string, limit int, trickle bool) (string, *webrtc.SessionDescription, error) {
+	return r.connect(rid, uid, jsep, limit, "", true, trickle)
+}
+
+// connect answers the offer after the gathering completes, unless trickle,
+// then the candidates are delivered by the candidates RPC or the socket.
+func (r *Router) connect(rid, uid string, jsep string, limit int, callback string, listen, trickle bool) (string, *webrtc.SessionDescription, error) {
 	if err := validateId(rid); err != nil {
 		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
 	}
@@ -130,10 +240,16 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 		return "", nil, buildError(ErrorInvalidSDP, err)
 	}
 
-	room := r.engine.GetRoom(rid)
-	room.Lock()
+	draining := r.engine.Draining()
+	room := r.engine.LockRoom(rid)
 	defer room.Unlock()
 
+	if draining && !room.active(uid) {
+		return "", nil, buildError(ErrorEngineDraining, fmt.Errorf("engine draining for new room %s", rid))
+	}
+	if until, banned := r.engine.moderation.banned(rid, uid); banned {
+		return "", nil, buildError(ErrorPeerBanned, fmt.Errorf("peer %s banned in %s until %s", uid, rid, until.Format(time.RFC3339)))
+	}
 	if limit > 0 {
 		for i, p := range room.m {
 			cid := uuid.FromStringOrNil(p.cid)
@@ -153,7 +269,7 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 	pc := make(chan *Peer)
 	ec := make(chan error)
 	go func() {
-		peer, err := r.create(rid, uid, callback, offer)
+		peer, err := r.create(rid, uid, callback, offer, listen, trickle)
 		if err != nil {
 			ec <- err
 		} else {
@@ -166,9 +282,11 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 	case peer := <-pc:
 		old := room.m[peer.uid]
 		if old != nil {
-			old.Close()
+			old.Close(peerCloseReplaced)
 		}
+		peer.muted.Store(r.engine.moderation.muted(rid, uid))
 		room.m[peer.uid] = peer
+		room.empty = false
 		return peer.cid, peer.pc.LocalDescription(), nil
 	case <-timer.C:
 		err := fmt.Errorf("publish(%s,%s) timeout", rid, uid)
@@ -176,6 +294,97 @@ func (r *Router) publish(rid, uid string, jsep string, limit int, callback strin
 	}
 }
 
+func (r *Router) watch(rid, uid string, jsep string) (string, *webrtc.SessionDescription, error) {
+	if err := validateId(rid); err != nil {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid format %s %s", rid, err.Error()))
+	}
+	if err := validateId(uid); err != nil {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid uid format %s %s", uid, err.Error()))
+	}
+	var offer webrtc.SessionDescription
+	err := json.Unmarshal([]byte(jsep), &offer)
+	if err != nil {
+		return "", nil, buildError(ErrorInvalidSDP, err)
+	}
+	if offer.Type != webrtc.SDPTypeOffer {
+		return "", nil, buildError(ErrorInvalidSDP, fmt.Errorf("invalid sdp type %s", offer.Type))
+	}
+
+	draining := r.engine.Draining()
+	room := r.engine.LockRoom(rid)
+	defer room.Unlock()
+
+	if draining && !room.active(uid) {
+		return "", nil, buildError(ErrorEngineDraining, fmt.Errorf("engine draining for new room %s", rid))
+	}
+	if until, banned := r.engine.moderation.banned(rid, uid); banned {
+		return "", nil, buildError(ErrorPeerBanned, fmt.Errorf("peer %s banned in %s until %s", uid, rid, until.Format(time.RFC3339)))
+	}
+	pc, getter, err := r.newPeerConnection()
+	if err != nil {
+		return "", nil, err
+	}
+	err = pc.SetRemoteDescription(offer)
+	if err != nil {
+		pc.Close()
+		return "", nil, buildError(ErrorServerSetRemoteOffer, err)
+	}
+
+	// the watcher publishes nothing, so it is connected without any track,
+	// and it can't renegotiate, thus each transceiver offered by the client
+	// is a last N slot, which is switched to the recent speakers of the room
+	// as they come and go
+	peer := BuildPeer(rid, uid, pc, getter, "", r.signal)
+	peer.closed = r.closed
+	peer.listener = true
+	peer.connected <- true
+	slots := make(map[webrtc.RTPCodecType]int)
+	for _, t := range pc.GetTransceivers() {
+		if t.Sender() == nil && t.Direction() != webrtc.RTPTransceiverDirectionRecvonly {
+			slots[t.Kind()] += 1
+		}
+	}
+	peer.Lock()
+	for kind, n := range slots {
+		codec := webrtc.MimeTypeOpus
+		if kind == webrtc.RTPCodecTypeVideo {
+			codec = offeredMime(pc, room.videoMimes(uid))
+		}
+		for i := 0; i < n; i++ {
+			err := peer.addSlot(i, kind, codec)
+			if err != nil {
+				peer.Unlock()
+				peer.Close(peerCloseError)
+				return "", nil, buildError(ErrorServerNewTrack, err)
+			}
+		}
+		peer.lastN = max(peer.lastN, n)
+	}
+	room.assignSlots(peer)
+	peer.Unlock()
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		peer.Close(peerCloseError)
+		return "", nil, buildError(ErrorServerCreateAnswer, err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		peer.Close(peerCloseError)
+		return "", nil, buildError(ErrorServerSetLocalAnswer, err)
+	}
+	<-gatherComplete
+
+	old := room.m[peer.uid]
+	if old != nil {
+		old.Close(peerCloseReplaced)
+	}
+	room.m[peer.uid] = peer
+	room.empty = false
+	return peer.cid, pc.LocalDescription(), nil
+}
+
 func (r *Router) restart(rid, uid, cid string, jsep string) (*webrtc.SessionDescription, error) {
 	room := r.engine.GetRoom(rid)
 	room.Lock()
@@ -219,7 +428,9 @@ func (r *Router) restart(rid, uid, cid string, jsep string) (*webrtc.SessionDesc
 		peer.pc.Close()
 		return nil, buildError(ErrorServerSetLocalAnswer, err)
 	}
-	<-gatherComplete
+	if peer.trickle == nil {
+		<-gatherComplete
+	}
 	return peer.pc.LocalDescription(), nil
 }
 
@@ -232,7 +443,7 @@ func (r *Router) end(rid, uid, cid string) error {
 	if err != nil {
 		return err
 	}
-	return peer.Close()
+	return peer.Close(peerCloseEnd)
 }
 
 func (r *Router) trickle(rid, uid, cid string, candi string) error {
@@ -277,39 +488,64 @@ func (r *Router) subscribe(rid, uid, cid string) (*webrtc.SessionDescription, er
 		peer.Lock()
 		defer peer.Unlock()
 
-		var renegotiate bool
+		renegotiate := peer.renegotiate
+		tracks := make(map[string]bool)
+		added, removed := make([]map[string]string, 0), make([]map[string]string, 0)
+		if peer.lastN > 0 {
+			created, err := peer.addSlots(peer.lastN, room.videoMimes(peer.uid))
+			if err != nil {
+				logger.Printf("failed to add slots to peer %s with error %s\n", peer.id(), err.Error())
+			}
+			renegotiate = renegotiate || created
+			added, removed = room.assignSlots(peer)
+			for _, s := range peer.publishers {
+				if s.slot != nil {
+					tracks[s.id] = true
+				}
+			}
+		}
 		for _, p := range room.m {
-			if p.uid == peer.uid {
+			if p.uid == peer.uid || peer.lastN > 0 {
 				continue
 			}
 			p.Lock()
-			old := peer.publishers[p.uid]
-
-			if old != nil && (p.track == nil || old.id != p.cid) {
-				err := peer.pc.RemoveTrack(old.rtp)
-				if err != nil {
-					logger.Printf("failed to remove sender %s from peer %s with error %s\n", p.id(), peer.id(), err.Error())
-				} else {
-					delete(peer.publishers, p.uid)
-					delete(p.subscribers, peer.uid)
-					renegotiate = true
+			for id, t := range p.tracks {
+				if peer.mixed != nil && t.kind == webrtc.RTPCodecTypeAudio {
+					continue
 				}
-			}
-			if p.track != nil && (old == nil || old.id != p.cid) {
-				sender, err := peer.pc.AddTrack(p.track)
+				tracks[id] = true
+				if peer.publishers[id] != nil {
+					continue
+				}
+				err := peer.subscribeTrack(p, t)
 				if err != nil {
-					logger.Printf("failed to add sender %s to peer %s with error %s\n", p.id(), peer.id(), err.Error())
-				} else if id := sender.Track().ID(); id != p.cid {
-					panic(fmt.Errorf("malformed peer and track id %s %s", p.cid, id))
+					logger.Printf("failed to add sender %s %s to peer %s with error %s\n", p.id(), id, peer.id(), err.Error())
 				} else {
-					peer.publishers[p.uid] = &Sender{id: p.cid, rtp: sender}
-					p.subscribers[peer.uid] = &Sender{id: peer.cid, rtp: sender}
+					added = append(added, map[string]string{"uid": p.uid, "track": id})
 					renegotiate = true
 				}
 			}
-
 			p.Unlock()
 		}
+		for id, old := range peer.publishers {
+			if tracks[id] {
+				continue
+			}
+			removal, err := room.dropSender(peer, id, old)
+			if err != nil {
+				logger.Printf("failed to remove sender %s %s from peer %s with error %s\n", old.uid, id, peer.id(), err.Error())
+				continue
+			}
+			item := map[string]string{"uid": old.uid, "track": id}
+			if old.slot != nil {
+				item["slot"] = old.slot.id
+			}
+			removed = append(removed, item)
+			renegotiate = renegotiate || removal
+		}
+		if len(added) > 0 || len(removed) > 0 {
+			peer.event(peer.cid, "onsubscription", map[string]any{"added": added, "removed": removed})
+		}
 		if !renegotiate {
 			ec <- nil
 			return
@@ -326,6 +562,11 @@ func (r *Router) subscribe(rid, uid, cid string) (*webrtc.SessionDescription, er
 			ec <- buildError(ErrorServerSetLocalOffer, err)
 			return
 		}
+		peer.renegotiate = false
+		if peer.trickle != nil {
+			gc <- struct{}{}
+			return
+		}
 		c := <-gatherComplete
 		gc <- c
 	}()
@@ -389,6 +630,94 @@ func (r *Router) answer(rid, uid, cid string, jsep string) error {
 	return nil
 }
 
+// lastN limits the publishers forwarded to the peer to the n most recently
+// active speakers, 0 to forward all of them.
+func (r *Router) lastN(rid, uid, cid string, n int) error {
+	if n < 0 {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid last n %d", n))
+	}
+
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	peer, err := room.get(uid, cid)
+	if err == nil {
+		peer.Lock()
+		peer.lastN = n
+		peer.Unlock()
+	}
+	room.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	r.signal(rid)
+	return nil
+}
+
+func (r *Router) layer(rid, uid, cid, target, layer string) error {
+	if !validateLayer(layer) {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid layer %s", layer))
+	}
+
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	defer room.RUnlock()
+
+	peer, err := room.get(uid, cid)
+	if err != nil {
+		return err
+	}
+	publisher := room.m[target]
+	if publisher == nil || publisher.uid == peer.uid {
+		return buildError(ErrorPeerNotFound, fmt.Errorf("peer %s not found in %s", target, rid))
+	}
+
+	peer.RLock()
+	defer peer.RUnlock()
+	publisher.RLock()
+	defer publisher.RUnlock()
+
+	for id, s := range peer.publishers {
+		t := publisher.tracks[id]
+		if s.uid != target || s.layers == nil || t == nil {
+			continue
+		}
+		if ssrc := t.setPreferred(s.layers, layer); ssrc != 0 {
+			go publisher.requestKeyframe(ssrc)
+		}
+	}
+	return nil
+}
+
+func videoCodecs() []webrtc.RTPCodecParameters {
+	feedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	codecs := []struct {
+		mime string
+		fmtp string
+		pts  []webrtc.PayloadType
+	}{
+		{webrtc.MimeTypeVP8, "", []webrtc.PayloadType{96, 120}},
+		{webrtc.MimeTypeVP9, "profile-id=0", []webrtc.PayloadType{98, 121}},
+		{webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", []webrtc.PayloadType{102}},
+		{webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", []webrtc.PayloadType{106, 126}},
+		{webrtc.MimeTypeAV1, "", []webrtc.PayloadType{45}},
+	}
+	var params []webrtc.RTPCodecParameters
+	for _, c := range codecs {
+		for _, pt := range c.pts {
+			params = append(params, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: c.mime, ClockRate: 90000, SDPFmtpLine: c.fmtp, RTCPFeedback: feedback},
+				PayloadType:        pt,
+			})
+		}
+	}
+	return params
+}
+
+func senderKey(uid, tid string) string {
+	return fmt.Sprintf("%s:%s", uid, tid)
+}
+
 func validateId(id string) error {
 	if len(id) > 256 {
 		return fmt.Errorf("id %s too long, the maximum is %d", id, 256)
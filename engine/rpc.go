@@ -24,6 +24,12 @@ type Call struct {
 	Id     string `json:"id"`
 	Method string `json:"method"`
 	Params []any  `json:"params"`
+	Token  string `json:"token,omitempty"`
+}
+
+type Renderer interface {
+	RenderData(data any)
+	RenderError(err error)
 }
 
 type Render struct {
@@ -69,8 +75,28 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 		render.New().JSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
 		return
 	}
-	renderer := NewRender(w, call.Id)
+	renderer := newMetricRenderer(NewRender(w, call.Id), call.Method)
 	logger.Printf("RPC.handle(id: %s, method: %s, params: %v)\n", call.Id, call.Method, call.Params)
+	if call.Token == "" {
+		call.Token = bearerToken(r.Header.Get("Authorization"))
+	}
+	if err := impl.authorize(&call); err != nil {
+		renderer.RenderError(err)
+		return
+	}
+	impl.dispatch(&call, renderer)
+}
+
+// rpcMethods are the methods dispatched, the others are recorded as invalid.
+var rpcMethods = []string{
+	"turn", "info", "list", "speakers", "stats", "record_start", "record_stop",
+	"publish", "join", "restart", "end", "trickle", "candidates", "subscribe",
+	"subscribe_mixed", "answer", "last_n", "layer", "mute", "kick", "ban", "drain",
+}
+
+// dispatch calls the method with the renderer, which should be wrapped by
+// newMetricRenderer before the authorization to record the rejected calls.
+func (impl *R) dispatch(call *Call, renderer Renderer) {
 	switch call.Method {
 	case "turn":
 		servers, err := impl.turn(call.Params)
@@ -93,6 +119,34 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 		} else {
 			renderer.RenderData(map[string]any{"peers": peers})
 		}
+	case "speakers":
+		speakers, dominant, err := impl.speakers(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]any{"speakers": speakers, "dominant": dominant})
+		}
+	case "stats":
+		stats, err := impl.stats(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(stats)
+		}
+	case "record_start":
+		rec, err := impl.recordStart(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(rec)
+		}
+	case "record_stop":
+		rec, err := impl.recordStop(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(rec)
+		}
 	case "publish":
 		cid, answer, err := impl.publish(call.Params)
 		if err != nil {
@@ -101,6 +155,14 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 			jsep, _ := json.Marshal(answer)
 			renderer.RenderData(map[string]any{"track": cid, "sdp": answer, "jsep": string(jsep)})
 		}
+	case "join":
+		cid, answer, err := impl.join(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			jsep, _ := json.Marshal(answer)
+			renderer.RenderData(map[string]any{"track": cid, "sdp": answer, "jsep": string(jsep)})
+		}
 	case "restart":
 		answer, err := impl.restart(call.Params)
 		if err != nil {
@@ -123,6 +185,13 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 		} else {
 			renderer.RenderData(map[string]string{})
 		}
+	case "candidates":
+		candidates, complete, err := impl.candidates(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]any{"candidates": candidates, "complete": complete})
+		}
 	case "subscribe":
 		offer, err := impl.subscribe(call.Params)
 		if err != nil {
@@ -131,6 +200,14 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 			jsep, _ := json.Marshal(offer)
 			renderer.RenderData(map[string]any{"type": offer.Type, "sdp": offer.SDP, "jsep": string(jsep)})
 		}
+	case "subscribe_mixed":
+		offer, err := impl.subscribeMixed(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			jsep, _ := json.Marshal(offer)
+			renderer.RenderData(map[string]any{"type": offer.Type, "sdp": offer.SDP, "jsep": string(jsep)})
+		}
 	case "answer":
 		err := impl.answer(call.Params)
 		if err != nil {
@@ -138,6 +215,48 @@ func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]strin
 		} else {
 			renderer.RenderData(map[string]string{})
 		}
+	case "last_n":
+		err := impl.lastN(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]string{})
+		}
+	case "layer":
+		err := impl.layer(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]string{})
+		}
+	case "mute":
+		err := impl.mute(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]string{})
+		}
+	case "kick":
+		err := impl.kick(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]string{})
+		}
+	case "ban":
+		err := impl.ban(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]string{})
+		}
+	case "drain":
+		state, err := impl.drain(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(state)
+		}
 	default:
 		renderer.RenderError(fmt.Errorf("invalid method %s", call.Method))
 	}
@@ -172,6 +291,39 @@ func (r *R) list(params []any) ([]map[string]any, error) {
 	return r.router.list(rid)
 }
 
+func (r *R) speakers(params []any) ([]*Speaker, string, error) {
+	if len(params) != 1 {
+		return nil, "", buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, "", buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	return r.router.speakers(rid)
+}
+
+func (r *R) recordStart(params []any) (*Recording, error) {
+	if len(params) != 1 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	return r.router.recordStart(rid, r.conf.Record.Dir)
+}
+
+func (r *R) recordStop(params []any) (*Recording, error) {
+	if len(params) != 1 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	return r.router.recordStop(rid)
+}
+
 func (r *R) publish(params []any) (string, *webrtc.SessionDescription, error) {
 	if len(params) < 3 {
 		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
@@ -205,7 +357,34 @@ func (r *R) publish(params []any) (string, *webrtc.SessionDescription, error) {
 		}
 		callback = cbk
 	}
-	return r.router.publish(rid, uid, sdp, limit, callback)
+	return r.router.publish(rid, uid, sdp, limit, callback, r.serverTrickle(sdp))
+}
+
+func (r *R) join(params []any) (string, *webrtc.SessionDescription, error) {
+	if len(params) != 3 && len(params) != 4 {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %v", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %v", params[1]))
+	}
+	sdp, ok := params[2].(string)
+	if !ok {
+		return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid sdp type %v", params[2]))
+	}
+	var limit int
+	if len(params) == 4 {
+		i, err := strconv.ParseInt(fmt.Sprint(params[3]), 10, 64)
+		if err != nil {
+			return "", nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid limit type %v %v", params[3], err))
+		}
+		limit = int(i)
+	}
+	return r.router.join(rid, uid, sdp, limit, r.serverTrickle(sdp))
 }
 
 func (r *R) restart(params []any) (*webrtc.SessionDescription, error) {
@@ -234,6 +413,17 @@ func (r *R) end(params []any) error {
 	return r.router.end(ids[0], ids[1], ids[2])
 }
 
+func (r *R) stats(params []any) (map[string]any, error) {
+	if len(params) != 3 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, err)
+	}
+	return r.router.stats(ids[0], ids[1], ids[2])
+}
+
 func (r *R) trickle(params []any) error {
 	if len(params) != 4 {
 		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
@@ -260,6 +450,17 @@ func (r *R) subscribe(params []any) (*webrtc.SessionDescription, error) {
 	return r.router.subscribe(ids[0], ids[1], ids[2])
 }
 
+func (r *R) subscribeMixed(params []any) (*webrtc.SessionDescription, error) {
+	if len(params) != 3 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return nil, buildError(ErrorInvalidParams, err)
+	}
+	return r.router.subscribeMixed(ids[0], ids[1], ids[2])
+}
+
 func (r *R) answer(params []any) error {
 	if len(params) != 4 {
 		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
@@ -275,6 +476,129 @@ func (r *R) answer(params []any) error {
 	return r.router.answer(ids[0], ids[1], ids[2], sdp)
 }
 
+func (r *R) layer(params []any) error {
+	if len(params) != 5 {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return buildError(ErrorInvalidParams, err)
+	}
+	target, ok := params[3].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid target type %s", params[3]))
+	}
+	layer, ok := params[4].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid layer type %s", params[4]))
+	}
+	return r.router.layer(ids[0], ids[1], ids[2], target, layer)
+}
+
+func (r *R) drain(params []any) (any, error) {
+	if len(params) != 0 {
+		return nil, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	r.router.engine.Drain()
+	return r.router.info()
+}
+
+func (r *R) lastN(params []any) error {
+	if len(params) != 4 {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return buildError(ErrorInvalidParams, err)
+	}
+	n, err := strconv.ParseInt(fmt.Sprint(params[3]), 10, 64)
+	if err != nil {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid n type %v %v", params[3], err))
+	}
+	return r.router.lastN(ids[0], ids[1], ids[2], int(n))
+}
+
+func (r *R) mute(params []any) error {
+	if len(params) != 3 {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %s", params[1]))
+	}
+	muted, ok := params[2].(bool)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid muted type %v", params[2]))
+	}
+	return r.router.mute(rid, uid, muted)
+}
+
+func (r *R) kick(params []any) error {
+	if len(params) != 2 {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %s", params[1]))
+	}
+	return r.router.kick(rid, uid)
+}
+
+func (r *R) ban(params []any) error {
+	if len(params) != 2 && len(params) != 3 {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	rid, ok := params[0].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid rid type %s", params[0]))
+	}
+	uid, ok := params[1].(string)
+	if !ok {
+		return buildError(ErrorInvalidParams, fmt.Errorf("invalid uid type %s", params[1]))
+	}
+	var seconds int64
+	if len(params) == 3 {
+		s, err := strconv.ParseInt(fmt.Sprint(params[2]), 10, 64)
+		if err != nil || s <= 0 {
+			return buildError(ErrorInvalidParams, fmt.Errorf("invalid duration %v %v", params[2], err))
+		}
+		seconds = s
+	}
+	return r.router.ban(rid, uid, time.Duration(seconds)*time.Second)
+}
+
+func (r *R) candidates(params []any) ([]webrtc.ICECandidateInit, bool, error) {
+	if len(params) != 3 {
+		return nil, false, buildError(ErrorInvalidParams, fmt.Errorf("invalid params count %d", len(params)))
+	}
+	ids, err := r.parseId(params)
+	if err != nil {
+		return nil, false, buildError(ErrorInvalidParams, err)
+	}
+	return r.router.candidates(ids[0], ids[1], ids[2])
+}
+
+// serverTrickle tells whether to answer the offer before the gathering
+// completes, which requires both the engine option and the offer to trickle.
+func (r *R) serverTrickle(jsep string) bool {
+	if !r.conf.Engine.Trickle {
+		return false
+	}
+	var offer webrtc.SessionDescription
+	if json.Unmarshal([]byte(jsep), &offer) != nil {
+		return false
+	}
+	return offerTrickle(offer.SDP)
+}
+
 func (r *R) parseId(params []any) ([]string, error) {
 	rid, ok := params[0].(string)
 	if !ok {
@@ -313,7 +637,8 @@ func handleCORS(handler http.Handler) http.Handler {
 		}
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Add("Access-Control-Allow-Headers", "Content-Type,Authorization,Mixin-Conversation-ID")
-		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS,GET,POST,DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "OPTIONS,GET,POST,PATCH,DELETE")
+		w.Header().Set("Access-Control-Expose-Headers", "Location,ETag")
 		w.Header().Set("Access-Control-Max-Age", "600")
 		if r.Method == "OPTIONS" {
 			render.New().JSON(w, http.StatusOK, map[string]any{})
@@ -328,7 +653,15 @@ func ServeRPC(engine *Engine, conf *Configuration) error {
 	impl := &R{router: NewRouter(engine), conf: conf}
 	router := httptreemux.New()
 	router.POST("/", impl.handle)
+	router.GET("/ws", impl.serveWebSocket)
+	router.POST("/whip/:rid/:uid", impl.whip)
+	router.PATCH("/whip/:rid/:uid/:cid", impl.ingestTrickle)
+	router.DELETE("/whip/:rid/:uid/:cid", impl.ingestEnd)
+	router.POST("/whep/:rid/:uid", impl.whep)
+	router.PATCH("/whep/:rid/:uid/:cid", impl.ingestTrickle)
+	router.DELETE("/whep/:rid/:uid/:cid", impl.ingestEnd)
 	registerHandlers(router)
+	registerMetrics(router, engine)
 	handler := handleCORS(router)
 	handler = handlers.ProxyHeaders(handler)
 
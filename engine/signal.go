@@ -0,0 +1,307 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	signalDebouncePeriod     = 300 * time.Millisecond
+	signalSocketPingPeriod   = 30 * time.Second
+	signalSocketReadTimeout  = 60 * time.Second
+	signalSocketWriteTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+type Session struct {
+	sync.Mutex
+	conn     *websocket.Conn
+	bindings map[string]string
+}
+
+type signaler struct {
+	sync.Mutex
+	sessions map[string]map[string]*Session
+	pending  map[string]bool
+}
+
+func newSignaler() *signaler {
+	return &signaler{
+		sessions: make(map[string]map[string]*Session),
+		pending:  make(map[string]bool),
+	}
+}
+
+func (s *Session) write(v any) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(signalSocketWriteTimeout))
+	return s.conn.WriteJSON(v)
+}
+
+type SocketRender struct {
+	session *Session
+	id      string
+	startAt time.Time
+	failed  bool
+}
+
+func (r *SocketRender) RenderData(data any) {
+	body := map[string]any{"data": data}
+	if r.id != "" {
+		body["id"] = r.id
+	}
+	err := r.session.write(body)
+	logger.Printf("RPC.socket(id: %s, time: %fs) OK %v\n", r.id, time.Now().Sub(r.startAt).Seconds(), err)
+}
+
+func (r *SocketRender) RenderError(err error) {
+	r.failed = true
+	body := map[string]any{"error": err}
+	if r.id != "" {
+		body["id"] = r.id
+	}
+	werr := r.session.write(body)
+	logger.Printf("RPC.socket(id: %s, time: %fs) ERROR %s %v\n", r.id, time.Now().Sub(r.startAt).Seconds(), err.Error(), werr)
+}
+
+// checkOrigin allows the socket from the configured origins, or from the
+// same host if none is configured, so that other websites can't open the
+// socket with the credentials of the browser. The clients other than the
+// browsers send no origin and are allowed.
+func (impl *R) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	origins := impl.conf.RPC.Origins
+	if len(origins) > 0 {
+		return slices.ContainsFunc(origins, func(o string) bool {
+			return o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin)
+		})
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (impl *R) serveWebSocket(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	upgrader := upgrader
+	upgrader.CheckOrigin = impl.checkOrigin
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Printf("RPC.socket() upgrade error %s\n", err.Error())
+		return
+	}
+	session := &Session{conn: conn, bindings: make(map[string]string)}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		impl.router.unbindSession(session)
+		conn.Close()
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(signalSocketReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(signalSocketReadTimeout))
+	})
+	go func() {
+		ticker := time.NewTicker(signalSocketPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				session.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(signalSocketWriteTimeout))
+				session.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			logger.Verbosef("RPC.socket() read error %s\n", err.Error())
+			return
+		}
+		var call Call
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&call); err != nil {
+			session.write(map[string]any{"error": err.Error()})
+			continue
+		}
+		logger.Printf("RPC.socket(id: %s, method: %s, params: %v)\n", call.Id, call.Method, call.Params)
+		renderer := &SocketRender{session: session, id: call.Id, startAt: time.Now()}
+		if err := impl.authorize(&call); err != nil {
+			newMetricRenderer(renderer, call.Method).RenderError(err)
+			continue
+		}
+		impl.dispatch(&call, newMetricRenderer(renderer, call.Method))
+		if renderer.failed || len(call.Params) < 3 {
+			continue
+		}
+
+		rid, _ := call.Params[0].(string)
+		uid, _ := call.Params[1].(string)
+		cid, _ := call.Params[2].(string)
+		switch call.Method {
+		case "publish", "join":
+		case "restart", "trickle", "candidates", "subscribe", "subscribe_mixed", "answer":
+			if !impl.router.matchPeer(rid, uid, cid) {
+				continue
+			}
+		default:
+			continue
+		}
+		if rid == "" || uid == "" {
+			continue
+		}
+		impl.router.bindSession(rid, uid, session)
+		if call.Method == "publish" || call.Method == "join" || call.Method == "restart" {
+			impl.router.pushCandidates(rid, uid)
+		}
+		if call.Method == "publish" || call.Method == "join" {
+			impl.router.signal(rid)
+		}
+	}
+}
+
+// matchPeer tells whether the cid is the live peer of uid in the room, so
+// that a socket can't take over the pushes of another peer.
+func (r *Router) matchPeer(rid, uid, cid string) bool {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return false
+	}
+	room.RLock()
+	defer room.RUnlock()
+
+	_, err := room.get(uid, cid)
+	return err == nil
+}
+
+func (r *Router) bindSession(rid, uid string, session *Session) {
+	s := r.signals
+	s.Lock()
+	defer s.Unlock()
+
+	session.Lock()
+	defer session.Unlock()
+
+	if old, ok := session.bindings[rid]; ok && old != uid {
+		delete(s.sessions[rid], old)
+	}
+	session.bindings[rid] = uid
+	if s.sessions[rid] == nil {
+		s.sessions[rid] = make(map[string]*Session)
+	}
+	s.sessions[rid][uid] = session
+}
+
+func (r *Router) unbindSession(session *Session) {
+	s := r.signals
+	s.Lock()
+	defer s.Unlock()
+
+	session.Lock()
+	defer session.Unlock()
+
+	for rid, uid := range session.bindings {
+		if s.sessions[rid][uid] == session {
+			delete(s.sessions[rid], uid)
+		}
+		if len(s.sessions[rid]) == 0 {
+			delete(s.sessions, rid)
+		}
+	}
+}
+
+// signal schedules a renegotiation for all the socket peers in the room,
+// changes within the debounce period are merged into one renegotiation.
+func (r *Router) signal(rid string) {
+	s := r.signals
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending[rid] || len(s.sessions[rid]) == 0 {
+		return
+	}
+	s.pending[rid] = true
+	go func() {
+		time.Sleep(signalDebouncePeriod)
+		s.Lock()
+		delete(s.pending, rid)
+		s.Unlock()
+		r.renegotiate(rid)
+	}()
+}
+
+func (r *Router) renegotiate(rid string) {
+	s := r.signals
+	s.Lock()
+	sessions := make(map[string]*Session)
+	for uid, session := range s.sessions[rid] {
+		sessions[uid] = session
+	}
+	s.Unlock()
+
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return
+	}
+	for uid, session := range sessions {
+		room.RLock()
+		peer := room.m[uid]
+		room.RUnlock()
+		if peer == nil {
+			continue
+		}
+		peer.RLock()
+		cid := peer.cid
+		peer.RUnlock()
+		if cid == peerTrackClosedId {
+			continue
+		}
+
+		offer, err := r.subscribe(rid, uid, cid)
+		if err != nil {
+			logger.Printf("renegotiate(%s,%s,%s) error %s\n", rid, uid, cid, err.Error())
+			continue
+		}
+		if offer.SDP == "" {
+			continue
+		}
+		jsep, _ := json.Marshal(offer)
+		err = session.write(map[string]any{
+			"method": "offer",
+			"data": map[string]any{
+				"rid":   rid,
+				"uid":   uid,
+				"track": cid,
+				"type":  offer.Type,
+				"sdp":   offer.SDP,
+				"jsep":  string(jsep),
+			},
+		})
+		logger.Verbosef("renegotiate(%s,%s,%s) push offer %v\n", rid, uid, cid, err)
+	}
+}
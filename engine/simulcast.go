@@ -0,0 +1,334 @@
+package engine
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	simulcastLayerLow    = "q"
+	simulcastLayerMedium = "h"
+	simulcastLayerHigh   = "f"
+)
+
+var simulcastLayers = []string{simulcastLayerLow, simulcastLayerMedium, simulcastLayerHigh}
+
+type Selection struct {
+	sync.Mutex
+	local     *localTrack
+	clockRate uint32
+	current   string
+	target    string
+	preferred string
+	started   bool
+	resumed   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+	lastAt    time.Time
+}
+
+func validateLayer(layer string) bool {
+	for _, l := range simulcastLayers {
+		if l == layer {
+			return true
+		}
+	}
+	return false
+}
+
+// pickLayer returns the preferred layer if available, otherwise the
+// closest lower one, and the lowest available layer as a last resort.
+func pickLayer(layers map[string]webrtc.SSRC, preferred string) string {
+	pi := len(simulcastLayers) - 1
+	for i, l := range simulcastLayers {
+		if l == preferred {
+			pi = i
+		}
+	}
+	for i := pi; i >= 0; i-- {
+		if _, ok := layers[simulcastLayers[i]]; ok {
+			return simulcastLayers[i]
+		}
+	}
+	for _, l := range simulcastLayers {
+		if _, ok := layers[l]; ok {
+			return l
+		}
+	}
+	return ""
+}
+
+func (t *Track) simulcast() bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	return len(t.layers) > 0
+}
+
+func (t *Track) layerSSRC(layer string) webrtc.SSRC {
+	t.RLock()
+	defer t.RUnlock()
+
+	if layer == "" {
+		return t.ssrc
+	}
+	return t.layers[layer]
+}
+
+func (t *Track) addSelection(key, stream, preferred string) (*Selection, error) {
+	lt, err := newLocalTrack(t.codec, t.id, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	sel := &Selection{local: lt, clockRate: t.codec.ClockRate, preferred: preferred}
+	sel.target = pickLayer(t.layers, preferred)
+	t.selections[key] = sel
+	return sel, nil
+}
+
+// resume continues the sequence numbers and timestamps of the last
+// selection forwarded to the same sender, the offsets are computed again
+// on the first packet forwarded, which must be a keyframe for videos.
+func (sel *Selection) resume(last *Selection) {
+	var started bool
+	var seq uint16
+	var ts uint32
+	var at time.Time
+	if last != nil {
+		last.Lock()
+		started, seq, ts, at = last.started, last.lastSeq, last.lastTs, last.lastAt
+		last.Unlock()
+	}
+
+	sel.Lock()
+	defer sel.Unlock()
+	sel.resumed = true
+	sel.started, sel.lastSeq, sel.lastTs, sel.lastAt = started, seq, ts, at
+}
+
+// layer returns the layer forwarded, or the target one before switching.
+func (sel *Selection) layer() string {
+	sel.Lock()
+	defer sel.Unlock()
+
+	if sel.current == "" || sel.resumed {
+		return sel.target
+	}
+	return sel.current
+}
+
+func (t *Track) removeSelection(key string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.selections, key)
+}
+
+// setPreferred updates the target layer of the selection, and returns the
+// SSRC of the layer to request a keyframe from, or zero if unchanged.
+func (t *Track) setPreferred(sel *Selection, preferred string) webrtc.SSRC {
+	t.RLock()
+	target := pickLayer(t.layers, preferred)
+	ssrc := t.layers[target]
+	t.RUnlock()
+
+	sel.Lock()
+	defer sel.Unlock()
+	sel.preferred = preferred
+	if target == "" || target == sel.target {
+		return 0
+	}
+	sel.target = target
+	return ssrc
+}
+
+// addLayer adds a simulcast layer arrived late or come back, and moves the
+// selections to it if it's closer to their preferred layers, it returns the
+// SSRCs to request keyframes from, or false if the layer exists.
+func (t *Track) addLayer(layer string, ssrc webrtc.SSRC) ([]webrtc.SSRC, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.layers[layer] != 0 {
+		return nil, false
+	}
+	t.layers[layer] = ssrc
+	var ssrcs []webrtc.SSRC
+	for _, sel := range t.selections {
+		sel.Lock()
+		if target := pickLayer(t.layers, sel.preferred); target != sel.target {
+			sel.target = target
+			ssrcs = append(ssrcs, t.layers[target])
+		}
+		sel.Unlock()
+	}
+	return ssrcs, true
+}
+
+// removeLayer drops a finished simulcast layer and moves all selections
+// forwarding it to the best remaining layer, it returns the SSRCs to request
+// keyframes from and the number of layers left.
+func (t *Track) removeLayer(layer string) ([]webrtc.SSRC, int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.layers, layer)
+	var ssrcs []webrtc.SSRC
+	for _, sel := range t.selections {
+		sel.Lock()
+		if sel.target == layer || sel.current == layer {
+			sel.target = pickLayer(t.layers, sel.preferred)
+			if sel.current == layer {
+				sel.current = ""
+			}
+			if ssrc := t.layers[sel.target]; ssrc != 0 {
+				ssrcs = append(ssrcs, ssrc)
+			}
+		}
+		sel.Unlock()
+	}
+	return ssrcs, len(t.layers)
+}
+
+// write forwards the packet to the local track shared by the subscribers,
+// and to the selections of the simulcast layers or the last N slots.
+func (t *Track) write(layer string, pkt *rtp.Packet) error {
+	t.RLock()
+	defer t.RUnlock()
+
+	if layer == "" {
+		err := writeRTP(t.local, pkt)
+		if err != nil || len(t.selections) == 0 {
+			return err
+		}
+	}
+	keyframe := t.kind == webrtc.RTPCodecTypeAudio || isKeyframe(t.codec.MimeType, pkt.Payload)
+	for _, sel := range t.selections {
+		err := sel.write(layer, pkt, keyframe)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write forwards the packet if it belongs to the current layer, layers are
+// only switched on keyframes, and the sequence numbers and timestamps are
+// rewritten so the subscriber sees one continuous stream.
+func (sel *Selection) write(layer string, pkt *rtp.Packet, keyframe bool) error {
+	sel.Lock()
+	defer sel.Unlock()
+
+	if layer != sel.current || sel.resumed {
+		if layer != sel.target || !keyframe {
+			return nil
+		}
+		if sel.started {
+			elapsed := uint32(time.Since(sel.lastAt).Milliseconds()) * sel.clockRate / 1000
+			if elapsed == 0 {
+				elapsed = 1
+			}
+			sel.seqOffset = sel.lastSeq + 1 - pkt.SequenceNumber
+			sel.tsOffset = sel.lastTs + elapsed - pkt.Timestamp
+		}
+		sel.current = layer
+		sel.started = true
+		sel.resumed = false
+	}
+
+	out := *pkt
+	out.Header.SequenceNumber = pkt.SequenceNumber + sel.seqOffset
+	out.Header.Timestamp = pkt.Timestamp + sel.tsOffset
+	sel.lastSeq = out.SequenceNumber
+	sel.lastTs = out.Timestamp
+	sel.lastAt = time.Now()
+	return writeRTP(sel.local, &out)
+}
+
+func isKeyframe(mime string, payload []byte) bool {
+	switch strings.ToLower(mime) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return len(payload) > 0 && payload[0]&0x08 != 0
+	}
+	return false
+}
+
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	x, s, pid := payload[0]&0x80 != 0, payload[0]&0x10 != 0, payload[0]&0x07
+	if !s || pid != 0 {
+		return false
+	}
+	i := 1
+	if x {
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 {
+			if len(payload) > i && payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if ext&0x40 != 0 {
+			i++
+		}
+		if ext&0x30 != 0 {
+			i++
+		}
+	}
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	p, b := payload[0]&0x40 != 0, payload[0]&0x08 != 0
+	return !p && b
+}
+
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch nalu := payload[0] & 0x1f; nalu {
+	case 5, 7:
+		return true
+	case 24:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == 5 || t == 7 {
+				return true
+			}
+			i += 2 + size
+		}
+	case 28:
+		if len(payload) < 2 {
+			return false
+		}
+		start, t := payload[1]&0x80 != 0, payload[1]&0x1f
+		return start && (t == 5 || t == 7)
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPickLayer(t *testing.T) {
+	all := map[string]webrtc.SSRC{"q": 1, "h": 2, "f": 3}
+	cases := []struct {
+		name      string
+		layers    map[string]webrtc.SSRC
+		preferred string
+		want      string
+	}{
+		{"preferred high", all, "f", "f"},
+		{"preferred medium", all, "h", "h"},
+		{"preferred low", all, "q", "q"},
+		{"unknown preferred takes the highest", all, "", "f"},
+		{"closest lower", map[string]webrtc.SSRC{"q": 1, "f": 3}, "h", "q"},
+		{"closest lower of high", map[string]webrtc.SSRC{"q": 1, "h": 2}, "f", "h"},
+		{"lowest available above", map[string]webrtc.SSRC{"h": 2, "f": 3}, "q", "h"},
+		{"only high", map[string]webrtc.SSRC{"f": 3}, "q", "f"},
+		{"no layers", map[string]webrtc.SSRC{}, "f", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := pickLayer(c.layers, c.preferred); got != c.want {
+				t.Fatalf("pickLayer(%v, %q) = %q, want %q", c.layers, c.preferred, got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsKeyframe(t *testing.T) {
+	cases := []struct {
+		name    string
+		mime    string
+		payload []byte
+		want    bool
+	}{
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"vp8 descriptor only", webrtc.MimeTypeVP8, []byte{0x10}, false},
+		{"vp8 key", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 key lower case mime", "video/vp8", []byte{0x10, 0x00}, true},
+		{"vp8 inter", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 not start", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 not first partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		{"vp8 extension truncated", webrtc.MimeTypeVP8, []byte{0x90}, false},
+		{"vp8 picture id truncated", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 long picture id truncated", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23}, false},
+		{"vp8 long picture id key", webrtc.MimeTypeVP8, []byte{0x90, 0x80, 0x81, 0x23, 0x00}, true},
+		{"vp8 picture id and tl0 key", webrtc.MimeTypeVP8, []byte{0x90, 0xc0, 0x05, 0x01, 0x00}, true},
+		{"vp8 all extensions truncated", webrtc.MimeTypeVP8, []byte{0x90, 0xf0, 0x05, 0x01, 0x20}, false},
+		{"vp9 empty", webrtc.MimeTypeVP9, nil, false},
+		{"vp9 key", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 inter", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"vp9 not start", webrtc.MimeTypeVP9, []byte{0x00}, false},
+		{"h264 empty", webrtc.MimeTypeH264, nil, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67}, true},
+		{"h264 non idr", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"h264 stap-a sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x42}, true},
+		{"h264 stap-a second idr", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x00, 0x00, 0x01, 0x65}, true},
+		{"h264 stap-a non idr", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x00}, false},
+		{"h264 stap-a header only", webrtc.MimeTypeH264, []byte{0x78}, false},
+		{"h264 stap-a size truncated", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x05}, false},
+		{"h264 stap-a size overflow", webrtc.MimeTypeH264, []byte{0x78, 0xff, 0xff, 0x41, 0x65}, false},
+		{"h264 fu-a idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x85}, true},
+		{"h264 fu-a idr middle", webrtc.MimeTypeH264, []byte{0x7c, 0x05}, false},
+		{"h264 fu-a non idr start", webrtc.MimeTypeH264, []byte{0x7c, 0x81}, false},
+		{"h264 fu-a truncated", webrtc.MimeTypeH264, []byte{0x7c}, false},
+		{"av1 empty", webrtc.MimeTypeAV1, nil, false},
+		{"av1 new sequence", webrtc.MimeTypeAV1, []byte{0x08}, true},
+		{"av1 inter", webrtc.MimeTypeAV1, []byte{0x10}, false},
+		{"unknown codec", webrtc.MimeTypeOpus, []byte{0x10, 0x00}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isKeyframe(c.mime, c.payload); got != c.want {
+				t.Fatalf("isKeyframe(%s, %x) = %v, want %v", c.mime, c.payload, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSelectionWrite(t *testing.T) {
+	codec := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	lt, err := newLocalTrack(codec, "video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := &Selection{local: lt, clockRate: codec.ClockRate, target: "f"}
+
+	// the switch from f to h continues right after the last packet of f, the
+	// timestamp gap is the time elapsed, so a loose upper bound is checked.
+	steps := []struct {
+		name      string
+		target    string
+		layer     string
+		seq       uint16
+		ts        uint32
+		keyframe  bool
+		forwarded bool
+		wantSeq   uint16
+		wantTs    uint32
+		slack     uint32
+	}{
+		{"other layer", "", "q", 10, 100, true, false, 0, 0, 0},
+		{"wait keyframe", "", "f", 1000, 5000, false, false, 0, 0, 0},
+		{"start on keyframe", "", "f", 1001, 5000, true, true, 1001, 5000, 0},
+		{"continue", "", "f", 1002, 8000, false, true, 1002, 8000, 0},
+		{"keep until switched", "h", "f", 1003, 11000, false, true, 1003, 11000, 0},
+		{"target waits keyframe", "", "h", 65534, 900000, false, false, 0, 0, 0},
+		{"switch on keyframe", "", "h", 65535, 900000, true, true, 1004, 11001, 9000},
+		{"old layer dropped", "", "f", 1004, 14000, true, false, 0, 0, 0},
+		{"continue across wrap", "", "h", 0, 903000, false, true, 1005, 14001, 9000},
+	}
+	for _, s := range steps {
+		if s.target != "" {
+			sel.target = s.target
+		}
+		lastSeq, lastTs := sel.lastSeq, sel.lastTs
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: s.seq, Timestamp: s.ts}, Payload: []byte{0x10, 0x00}}
+		err := sel.write(s.layer, pkt, s.keyframe)
+		if err != nil {
+			t.Fatalf("%s: write error %v", s.name, err)
+		}
+		if !s.forwarded {
+			if sel.lastSeq != lastSeq || sel.lastTs != lastTs {
+				t.Fatalf("%s: forwarded seq %d ts %d", s.name, sel.lastSeq, sel.lastTs)
+			}
+			continue
+		}
+		if sel.lastSeq != s.wantSeq {
+			t.Fatalf("%s: seq %d, want %d", s.name, sel.lastSeq, s.wantSeq)
+		}
+		if sel.lastTs < s.wantTs || sel.lastTs > s.wantTs+s.slack {
+			t.Fatalf("%s: ts %d, want %d to %d", s.name, sel.lastTs, s.wantTs, s.wantTs+s.slack)
+		}
+		if pkt.SequenceNumber != s.seq || pkt.Timestamp != s.ts {
+			t.Fatalf("%s: source packet rewritten", s.name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	audioLevelURI = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+	speakerLoopPeriod      = 500 * time.Millisecond
+	speakerLevelTimeout    = 1 * time.Second
+	speakerLevelSmoothing  = 0.1
+	speakerActiveThreshold = 127 - 50
+	speakerDominantMargin  = 6
+)
+
+// Speaker level is the smoothed RFC 6464 audio level inverted to 0-127,
+// the higher the louder, and 0 means silence.
+type Speaker struct {
+	Id     string `json:"id"`
+	Level  int    `json:"level"`
+	Active bool   `json:"active"`
+}
+
+type audioLevel struct {
+	sync.Mutex
+	value     float64
+	updatedAt time.Time
+}
+
+func (al *audioLevel) update(level uint8) {
+	al.Lock()
+	defer al.Unlock()
+
+	activity := float64(127 - level)
+	if time.Since(al.updatedAt) > speakerLevelTimeout {
+		al.value = activity
+	} else {
+		al.value += (activity - al.value) * speakerLevelSmoothing
+	}
+	al.updatedAt = time.Now()
+}
+
+func (al *audioLevel) get() int {
+	al.Lock()
+	defer al.Unlock()
+
+	if time.Since(al.updatedAt) > speakerLevelTimeout {
+		return 0
+	}
+	return int(al.value)
+}
+
+func audioLevelExtensionId(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == audioLevelURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+func (peer *Peer) updateAudioLevel(pkt *rtp.Packet, ext uint8) {
+	b := pkt.GetExtension(ext)
+	if b == nil {
+		return
+	}
+	var al rtp.AudioLevelExtension
+	if err := al.Unmarshal(b); err != nil {
+		return
+	}
+	peer.level.update(al.Level)
+}
+
+func (engine *Engine) SpeakerLoop() {
+	for {
+		for _, pm := range engine.snapshot() {
+			speakers, callbacks, changed := pm.rankSpeakers()
+			if !changed || len(speakers) == 0 {
+				continue
+			}
+			for _, cbk := range callbacks {
+				engine.webhook.enqueue(cbk, map[string]any{
+					"rid":      pm.id,
+					"uid":      speakers[0].Id,
+					"action":   "onspeaker",
+					"speakers": speakers,
+				})
+			}
+		}
+		time.Sleep(speakerLoopPeriod)
+	}
+}
+
+// rankSpeakers sorts the room peers by their smoothed audio levels, the
+// dominant speaker is kept until another one is louder by a margin, and
+// the callbacks of the room are returned when it changes. The slots of the
+// last N peers are switched to the most recently active speakers. It never
+// waits the room or peers busy, e.g. in a connect or subscribe, which are
+// ranked by the next tick instead.
+func (room *pmap) rankSpeakers() ([]*Speaker, []string, bool) {
+	if !room.TryLock() {
+		return nil, nil, false
+	}
+	defer room.Unlock()
+
+	speakers := make([]*Speaker, 0)
+	callbacks := make(map[string]bool)
+	publishers := make(map[string]bool)
+	for _, p := range room.m {
+		if p.cid == peerTrackClosedId {
+			continue
+		}
+		if !p.TryRLock() {
+			return nil, nil, false
+		}
+		publishers[p.uid] = len(p.tracks) > 0
+		p.RUnlock()
+		level := p.level.get()
+		speakers = append(speakers, &Speaker{
+			Id:     p.uid,
+			Level:  level,
+			Active: level >= speakerActiveThreshold,
+		})
+		if p.callback != "" {
+			callbacks[p.callback] = true
+		}
+	}
+	sort.Slice(speakers, func(i, j int) bool {
+		if speakers[i].Level == speakers[j].Level {
+			return speakers[i].Id < speakers[j].Id
+		}
+		return speakers[i].Level > speakers[j].Level
+	})
+
+	var current *Speaker
+	for _, s := range speakers {
+		if s.Id == room.dominant {
+			current = s
+		}
+	}
+	changed := false
+	if current == nil {
+		room.dominant = ""
+	}
+	if len(speakers) > 0 && speakers[0].Active && speakers[0].Id != room.dominant {
+		if current == nil || !current.Active || speakers[0].Level > current.Level+speakerDominantMargin {
+			room.dominant = speakers[0].Id
+			changed = true
+		}
+	}
+	if room.dominant != "" && speakers[0].Id != room.dominant {
+		for i, s := range speakers {
+			if s.Id == room.dominant {
+				speakers = append([]*Speaker{s}, append(speakers[:i:i], speakers[i+1:]...)...)
+				break
+			}
+		}
+	}
+	room.speakers = speakers
+	room.updateRecent(speakers, publishers)
+	room.switchSlots()
+
+	urls := make([]string, 0, len(callbacks))
+	for cbk := range callbacks {
+		urls = append(urls, cbk)
+	}
+	return speakers, urls, changed
+}
@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+// stats returns the RTP statistics of the peer inbound tracks and the
+// senders it subscribes, recorded by the stats interceptor from the RTP
+// packets and the RTCP reports, with the selected ICE candidate pair.
+func (p *Peer) stats() map[string]any {
+	report := p.pc.GetStats()
+
+	p.RLock()
+	defer p.RUnlock()
+
+	tracks := make([]map[string]any, 0)
+	for _, t := range p.sortedTracks() {
+		ssrcs := map[string]uint32{"": uint32(t.ssrc)}
+		if t.simulcast() {
+			ssrcs = make(map[string]uint32)
+			t.RLock()
+			for layer, ssrc := range t.layers {
+				ssrcs[layer] = uint32(ssrc)
+			}
+			t.RUnlock()
+		}
+		for layer, ssrc := range ssrcs {
+			item := map[string]any{
+				"id":    t.id,
+				"kind":  t.kind.String(),
+				"layer": layer,
+				"ssrc":  ssrc,
+			}
+			if s := p.getter.Get(ssrc); s != nil {
+				item["inbound"] = inboundStats(s, t.codec.ClockRate)
+			}
+			tracks = append(tracks, item)
+		}
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if tracks[i]["id"] == tracks[j]["id"] {
+			return tracks[i]["layer"].(string) < tracks[j]["layer"].(string)
+		}
+		return tracks[i]["id"].(string) < tracks[j]["id"].(string)
+	})
+
+	senders := make([]map[string]any, 0)
+	for key, s := range p.publishers {
+		item := map[string]any{
+			"id":    key,
+			"uid":   s.uid,
+			"track": s.id,
+		}
+		if s.slot != nil {
+			item["slot"] = s.slot.id
+		}
+		if s.layers != nil {
+			s.layers.Lock()
+			item["layer"] = s.layers.current
+			s.layers.Unlock()
+		}
+		encodings := s.rtp.GetParameters().Encodings
+		if len(encodings) > 0 {
+			ssrc := uint32(encodings[0].SSRC)
+			item["ssrc"] = ssrc
+			if st := p.getter.Get(ssrc); st != nil {
+				item["outbound"] = outboundStats(st)
+			}
+		}
+		senders = append(senders, item)
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i]["id"].(string) < senders[j]["id"].(string) })
+
+	return map[string]any{
+		"id":             p.uid,
+		"track":          p.cid,
+		"candidate_pair": p.candidatePair(report),
+		"tracks":         tracks,
+		"senders":        senders,
+	}
+}
+
+// inboundStats converts the interceptor jitter from the RTP timestamp units
+// to seconds, as the jitter of the receiver reports for the senders.
+func inboundStats(s *stats.Stats, clockRate uint32) map[string]any {
+	in := s.InboundRTPStreamStats
+	jitter := 0.0
+	if clockRate > 0 {
+		jitter = in.Jitter / float64(clockRate)
+	}
+	return map[string]any{
+		"packets_received": in.PacketsReceived,
+		"packets_lost":     in.PacketsLost,
+		"bytes_received":   in.BytesReceived,
+		"nack_count":       in.NACKCount,
+		"pli_count":        in.PLICount,
+		"fir_count":        in.FIRCount,
+		"jitter":           jitter,
+		"rtt":              s.RemoteOutboundRTPStreamStats.RoundTripTime.Seconds(),
+		"reports_received": s.RemoteOutboundRTPStreamStats.ReportsSent,
+	}
+}
+
+func outboundStats(s *stats.Stats) map[string]any {
+	out, remote := s.OutboundRTPStreamStats, s.RemoteInboundRTPStreamStats
+	return map[string]any{
+		"packets_sent":  out.PacketsSent,
+		"bytes_sent":    out.BytesSent,
+		"nack_count":    out.NACKCount,
+		"pli_count":     out.PLICount,
+		"fir_count":     out.FIRCount,
+		"packets_lost":  remote.PacketsLost,
+		"fraction_lost": remote.FractionLost,
+		"jitter":        remote.Jitter,
+		"rtt":           remote.RoundTripTime.Seconds(),
+	}
+}
+
+func (p *Peer) candidatePair(report webrtc.StatsReport) map[string]any {
+	pair, err := p.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return nil
+	}
+	address := func(c *webrtc.ICECandidate) string {
+		return fmt.Sprintf("%s:%d", c.Address, c.Port)
+	}
+	item := map[string]any{
+		"local": map[string]any{
+			"address":  address(pair.Local),
+			"protocol": pair.Local.Protocol.String(),
+			"type":     pair.Local.Typ.String(),
+		},
+		"remote": map[string]any{
+			"address":  address(pair.Remote),
+			"protocol": pair.Remote.Protocol.String(),
+			"type":     pair.Remote.Typ.String(),
+		},
+	}
+
+	candidates := make(map[string]string)
+	for id, s := range report {
+		switch c := s.(type) {
+		case webrtc.ICECandidateStats:
+			candidates[id] = fmt.Sprintf("%s:%d", c.IP, c.Port)
+		}
+	}
+	for _, s := range report {
+		cp, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok {
+			continue
+		}
+		if candidates[cp.LocalCandidateID] != address(pair.Local) || candidates[cp.RemoteCandidateID] != address(pair.Remote) {
+			continue
+		}
+		item["state"] = cp.State
+		item["rtt"] = cp.CurrentRoundTripTime
+		item["bytes_sent"] = cp.BytesSent
+		item["bytes_received"] = cp.BytesReceived
+	}
+	return item
+}
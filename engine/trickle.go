@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/webrtc/v3"
+)
+
+// iceTrickle collects the local candidates of a peer connection answered
+// before the gathering completes, they are reset when each ICE generation
+// starts gathering, so an ICE restart never pushes the stale candidates.
+type iceTrickle struct {
+	sync.Mutex
+	cid        string
+	candidates []webrtc.ICECandidateInit
+	complete   bool
+}
+
+func (t *iceTrickle) bind(cid string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.cid = cid
+}
+
+func (t *iceTrickle) add(c *webrtc.ICECandidate) {
+	t.Lock()
+	defer t.Unlock()
+
+	if c == nil {
+		t.complete = true
+	} else {
+		t.candidates = append(t.candidates, c.ToJSON())
+	}
+}
+
+func (t *iceTrickle) reset() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.candidates = nil
+	t.complete = false
+}
+
+func (t *iceTrickle) snapshot() ([]webrtc.ICECandidateInit, bool, string) {
+	t.Lock()
+	defer t.Unlock()
+
+	candidates := make([]webrtc.ICECandidateInit, len(t.candidates))
+	copy(candidates, t.candidates)
+	return candidates, t.complete, t.cid
+}
+
+// offerTrickle tells whether the offer declares the trickle ICE option at
+// either the session or the media level.
+func offerTrickle(sdp string) bool {
+	for _, l := range strings.Split(sdp, "\n") {
+		opts, ok := strings.CutPrefix(strings.TrimSpace(l), "a=ice-options:")
+		if ok && strings.Contains(" "+opts+" ", " trickle ") {
+			return true
+		}
+	}
+	return false
+}
+
+// trickleCandidates answers the peer connection without waiting for the
+// gathering, each local candidate is pushed to the socket of the peer.
+// The restart gathering starts after the agent dropped the old candidates,
+// so the list is reset right there instead of before the new answer.
+func (r *Router) trickleCandidates(pc *webrtc.PeerConnection, rid, uid string) *iceTrickle {
+	t := &iceTrickle{}
+	pc.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
+		if state == webrtc.ICEGathererStateGathering {
+			t.reset()
+		}
+	})
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		t.add(c)
+		r.writeCandidates(rid, uid, t)
+	})
+	return t
+}
+
+func (r *Router) candidates(rid, uid, cid string) ([]webrtc.ICECandidateInit, bool, error) {
+	room := r.engine.GetRoom(rid)
+	room.RLock()
+	peer, err := room.get(uid, cid)
+	room.RUnlock()
+
+	if err != nil {
+		return nil, false, err
+	}
+	if peer.trickle == nil {
+		return []webrtc.ICECandidateInit{}, true, nil
+	}
+	candidates, complete, _ := peer.trickle.snapshot()
+	return candidates, complete, nil
+}
+
+// pushCandidates writes the candidates of the live peer of uid to the socket
+// just bound to it.
+func (r *Router) pushCandidates(rid, uid string) {
+	room := r.engine.getRoom(rid)
+	if room == nil {
+		return
+	}
+	room.RLock()
+	peer := room.m[uid]
+	room.RUnlock()
+	if peer == nil || peer.trickle == nil {
+		return
+	}
+	if peer.currentId() == peerTrackClosedId {
+		return
+	}
+	r.writeCandidates(rid, uid, peer.trickle)
+}
+
+// writeCandidates writes all the local candidates gathered so far by t to
+// the socket bound to uid, the client should ignore the duplicated ones.
+// The candidates of a peer still being created, thus not yet bound to its
+// cid, are left to the push after the publish or join returns.
+func (r *Router) writeCandidates(rid, uid string, t *iceTrickle) {
+	candidates, complete, cid := t.snapshot()
+	if cid == "" {
+		return
+	}
+
+	s := r.signals
+	s.Lock()
+	session := s.sessions[rid][uid]
+	s.Unlock()
+	if session == nil {
+		return
+	}
+
+	err := session.write(map[string]any{
+		"method": "candidates",
+		"data": map[string]any{
+			"rid":        rid,
+			"uid":        uid,
+			"track":      cid,
+			"candidates": candidates,
+			"complete":   complete,
+		},
+	})
+	if err != nil {
+		logger.Printf("writeCandidates(%s,%s,%s) error %s\n", rid, uid, cid, err.Error())
+	}
+}
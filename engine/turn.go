@@ -5,7 +5,21 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	pionturn "github.com/pion/turn/v2"
+)
+
+const (
+	turnDefaultRealm  = "kraken"
+	turnRelayPortMin  = 49152
+	turnRelayPortMax  = 65535
+	turnCredentialTTL = 1 * time.Hour
+	turnRelayAllocTry = 16
 )
 
 type NTS struct {
@@ -15,13 +29,12 @@ type NTS struct {
 }
 
 func turn(conf *Configuration, uid string) ([]*NTS, error) {
-	timestamp := time.Now().Add(1 * time.Hour).Unix()
+	timestamp := time.Now().Add(turnCredentialTTL).Unix()
 	username := fmt.Sprintf("%d:%s", timestamp, uid)
-	mac := hmac.New(sha1.New, []byte(conf.Turn.Secret))
-	if _, err := mac.Write([]byte(username)); err != nil {
+	credential, err := turnCredential(conf.Turn.Secret, username)
+	if err != nil {
 		return nil, err
 	}
-	credential := base64.StdEncoding.EncodeToString(mac.Sum(nil))
 	url := conf.Turn.Host
 	ownUDP := &NTS{
 		URLs:       url + "?transport=udp",
@@ -35,3 +48,146 @@ func turn(conf *Configuration, uid string) ([]*NTS, error) {
 	}
 	return []*NTS{ownUDP, ownTCP}, nil
 }
+
+func turnCredential(secret, username string) (string, error) {
+	mac := hmac.New(sha1.New, []byte(secret))
+	if _, err := mac.Write([]byte(username)); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// ServeTURN starts the embedded TURN server on both UDP and TCP of the
+// listen address, it accepts the time limited credentials issued by turn,
+// and relays with the ports in the relay range of the engine IP.
+func ServeTURN(engine *Engine, conf *Configuration) (*pionturn.Server, error) {
+	tc := &conf.Turn
+	if tc.Secret == "" {
+		return nil, fmt.Errorf("embedded TURN requires the secret")
+	}
+	_, port, err := net.SplitHostPort(tc.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if tc.Host == "" {
+		tc.Host = fmt.Sprintf("turn:%s:%s", engine.IP, port)
+	}
+	realm := tc.Realm
+	if realm == "" {
+		realm = turnDefaultRealm
+	}
+	relay := tc.RelayAddress
+	if relay == "" {
+		relay = engine.IP
+	}
+	portMin, portMax := tc.RelayPortMin, tc.RelayPortMax
+	if portMin == 0 || portMax == 0 {
+		portMin, portMax = turnRelayPortMin, turnRelayPortMax
+	}
+	allowed := []net.IP{net.ParseIP(engine.IP), net.ParseIP(relay)}
+	allowed = append(allowed, interfaceIPs(engine.Interface)...)
+	permission := turnPermissionHandler(allowed)
+	generator := func() pionturn.RelayAddressGenerator {
+		return &pionturn.RelayAddressGeneratorPortRange{
+			RelayAddress: net.ParseIP(relay),
+			Address:      "0.0.0.0",
+			MinPort:      portMin,
+			MaxPort:      portMax,
+			MaxRetries:   turnRelayAllocTry,
+		}
+	}
+
+	udp, err := net.ListenPacket("udp4", tc.Listen)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp4", tc.Listen)
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	server, err := pionturn.NewServer(pionturn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: turnAuthHandler(tc.Secret),
+		PacketConnConfigs: []pionturn.PacketConnConfig{{
+			PacketConn:            udp,
+			RelayAddressGenerator: generator(),
+			PermissionHandler:     permission,
+		}},
+		ListenerConfigs: []pionturn.ListenerConfig{{
+			Listener:              tcp,
+			RelayAddressGenerator: generator(),
+			PermissionHandler:     permission,
+		}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, err
+	}
+	logger.Printf("ServeTURN(%s, %s, %s, %d-%d) with %s\n", tc.Listen, realm, relay, portMin, portMax, tc.Host)
+	return server, nil
+}
+
+// turnAuthHandler validates the usernames of the expiry timestamp and the
+// uid, which are signed by the shared secret in turn.
+func turnAuthHandler(secret string) pionturn.AuthHandler {
+	return func(username, realm string, addr net.Addr) ([]byte, bool) {
+		ts, _, _ := strings.Cut(username, ":")
+		expire, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || expire < time.Now().Unix() {
+			logger.Verbosef("turnAuthHandler(%s, %s) invalid or expired\n", username, addr)
+			return nil, false
+		}
+		password, err := turnCredential(secret, username)
+		if err != nil {
+			return nil, false
+		}
+		return pionturn.GenerateAuthKey(username, realm, password), true
+	}
+}
+
+// turnPermissionHandler denies relaying to the loopback, private, link local,
+// multicast and unspecified peer IPs, like the denied-peer-ip of coturn, so
+// that the relays can't reach the internal networks of the engine. The
+// allowed IPs of the engine itself are always permitted, otherwise the
+// clients can't relay to its candidates on a private network.
+func turnPermissionHandler(allowed []net.IP) pionturn.PermissionHandler {
+	return func(addr net.Addr, ip net.IP) bool {
+		for _, a := range allowed {
+			if a.Equal(ip) {
+				return true
+			}
+		}
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+			ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+			ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+			logger.Verbosef("turnPermissionHandler(%s, %s) denied\n", addr, ip)
+			return false
+		}
+		return true
+	}
+}
+
+// interfaceIPs returns all the addresses of the named interface, or none if
+// it's not found.
+func interfaceIPs(iname string) []net.IP {
+	i, err := net.InterfaceByName(iname)
+	if err != nil {
+		return nil
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ips = append(ips, v.IP)
+		case *net.IPAddr:
+			ips = append(ips, v.IP)
+		}
+	}
+	return ips
+}
@@ -0,0 +1,469 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	webhookTimeout          = 30 * time.Second
+	webhookTimestampHeader  = "X-Kraken-Timestamp"
+	webhookSignatureHeader  = "X-Kraken-Signature"
+	webhookQueueSize        = 1024
+	webhookRetries          = 5
+	webhookBackoffBase      = time.Second
+	webhookBackoffMax       = 5 * time.Minute
+	webhookBreakerThreshold = 5
+	webhookBreakerCooldown  = 30 * time.Second
+	webhookFlushPeriod      = 100 * time.Millisecond
+	webhookFlushDeadline    = 10 * time.Second
+
+	webhookOnTrackClose  = "close"
+	webhookOnTrackIgnore = "ignore"
+
+	peerCloseTimeout     = "timeout"
+	peerCloseReplaced    = "replaced"
+	peerCloseEnd         = "end"
+	peerCloseReadTimeout = "read_timeout"
+	peerCloseCallback    = "callback"
+	peerCloseError       = "error"
+	peerCloseKick        = "kick"
+	peerCloseBan         = "ban"
+	peerCloseDrain       = "drain"
+)
+
+// Webhook delivers the peer and room events to the callback URLs, each body
+// is signed with the HMAC-SHA256 of the timestamp and the body by the secret.
+// The events are queued and dispatched by the loop in the background to the
+// worker of each endpoint, so that a hung endpoint delays only its own
+// events. They are retried with exponential backoff on network or server
+// errors, and written to the dead letter log once they run out of retries,
+// are answered with other statuses, or the queue is full. Each endpoint has
+// a circuit breaker, which holds its events for the cooldown after the
+// consecutive failures reach the threshold. The events still pending when
+// the flush deadline passes are written to the dead letter log.
+type Webhook struct {
+	sync.Mutex
+	secret     string
+	client     *http.Client
+	queue      chan *webhookDelivery
+	queueSize  int
+	retries    int
+	threshold  int
+	cooldown   time.Duration
+	breakers   map[string]*webhookBreaker
+	endpoints  map[string]*webhookEndpoint
+	waiting    map[*webhookDelivery]*time.Timer
+	flushed    bool
+	deadLetter string
+	pending    atomic.Int64
+	onTrack    string
+}
+
+type webhookDelivery struct {
+	url       string
+	action    string
+	body      []byte
+	attempts  int
+	createdAt time.Time
+	done      func(error)
+}
+
+// webhookEndpoint holds the events dispatched to an endpoint, they are
+// posted in order by its worker, which quits once they are all posted.
+type webhookEndpoint struct {
+	queue []*webhookDelivery
+}
+
+type webhookBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+func BuildWebhook(conf *Configuration) *Webhook {
+	c := conf.Callback
+	w := &Webhook{
+		secret:     c.Secret,
+		client:     &http.Client{Timeout: webhookTimeout},
+		queue:      make(chan *webhookDelivery, webhookQueueSize),
+		queueSize:  webhookQueueSize,
+		retries:    webhookRetries,
+		threshold:  webhookBreakerThreshold,
+		cooldown:   webhookBreakerCooldown,
+		breakers:   make(map[string]*webhookBreaker),
+		endpoints:  make(map[string]*webhookEndpoint),
+		waiting:    make(map[*webhookDelivery]*time.Timer),
+		deadLetter: c.DeadLetter,
+		onTrack:    webhookOnTrackClose,
+	}
+	if c.Timeout > 0 {
+		w.client.Timeout = time.Duration(c.Timeout) * time.Second
+	}
+	if c.QueueSize > 0 {
+		w.queue = make(chan *webhookDelivery, c.QueueSize)
+		w.queueSize = c.QueueSize
+	}
+	if c.Retries > 0 {
+		w.retries = c.Retries
+	}
+	if c.BreakerThreshold > 0 {
+		w.threshold = c.BreakerThreshold
+	}
+	if c.BreakerCooldown > 0 {
+		w.cooldown = time.Duration(c.BreakerCooldown) * time.Second
+	}
+	if c.OnTrack == webhookOnTrackIgnore {
+		w.onTrack = webhookOnTrackIgnore
+	}
+	return w
+}
+
+// Loop dispatches the queued events to the workers of their endpoints, the
+// events of an endpoint with the breaker open are held until it's closed.
+func (w *Webhook) Loop() {
+	for d := range w.queue {
+		if wait := w.breakerWait(d.url); wait > 0 {
+			w.retry(d, wait)
+			continue
+		}
+		w.dispatch(d)
+	}
+}
+
+func (w *Webhook) dispatch(d *webhookDelivery) {
+	w.Lock()
+	if w.flushed {
+		w.Unlock()
+		w.dead(d, fmt.Errorf("flush deadline"))
+		return
+	}
+	ep := w.endpoints[d.url]
+	if ep == nil {
+		ep = &webhookEndpoint{}
+		w.endpoints[d.url] = ep
+		go w.deliver(d.url, ep)
+	}
+	if len(ep.queue) >= w.queueSize {
+		w.Unlock()
+		w.dead(d, fmt.Errorf("queue full"))
+		return
+	}
+	ep.queue = append(ep.queue, d)
+	w.Unlock()
+}
+
+// deliver posts the events of the endpoint one by one, and quits once its
+// queue is empty, the next event dispatched starts a new worker.
+func (w *Webhook) deliver(url string, ep *webhookEndpoint) {
+	for {
+		w.Lock()
+		if len(ep.queue) == 0 {
+			delete(w.endpoints, url)
+			w.Unlock()
+			return
+		}
+		d := ep.queue[0]
+		ep.queue = ep.queue[1:]
+		w.Unlock()
+
+		if wait := w.breakerWait(d.url); wait > 0 {
+			w.retry(d, wait)
+			continue
+		}
+		d.attempts += 1
+		err := w.post(d.url, d.body)
+		w.breakerReport(d.url, err)
+		switch {
+		case err == nil:
+			metricCallbacks.WithLabelValues("delivered").Inc()
+			w.pending.Add(-1)
+			if d.done != nil {
+				d.done(nil)
+			}
+		case !webhookRetryable(err) || d.attempts > w.retries:
+			w.dead(d, err)
+		default:
+			logger.Verbosef("Webhook.deliver(%s, %s) attempt %d error %v\n", d.url, d.action, d.attempts, err)
+			metricCallbacks.WithLabelValues("retried").Inc()
+			w.retry(d, webhookBackoff(d.attempts))
+		}
+	}
+}
+
+// Flush waits the queued events to be delivered or dead before the
+// deadline, it's called before the engine exits. When the deadline passes,
+// the events queued, dispatched or waiting to retry are written to the dead
+// letter log, and so are the events queued after it.
+func (w *Webhook) Flush(deadline time.Duration) {
+	start := time.Now()
+	for w.pending.Load() > 0 && time.Since(start) < deadline {
+		time.Sleep(webhookFlushPeriod)
+	}
+	if w.pending.Load() == 0 {
+		return
+	}
+
+	w.Lock()
+	w.flushed = true
+	var left []*webhookDelivery
+	for d, t := range w.waiting {
+		if t.Stop() {
+			left = append(left, d)
+		}
+	}
+	w.waiting = make(map[*webhookDelivery]*time.Timer)
+	for _, ep := range w.endpoints {
+		left = append(left, ep.queue...)
+		ep.queue = nil
+	}
+	w.Unlock()
+	for len(w.queue) > 0 {
+		select {
+		case d := <-w.queue:
+			left = append(left, d)
+		default:
+		}
+	}
+	for _, d := range left {
+		w.dead(d, fmt.Errorf("flush deadline"))
+	}
+	if n := w.pending.Load(); n > 0 {
+		logger.Printf("Webhook.Flush(%s) %d events left\n", deadline, n)
+	}
+}
+
+// hold counts an event which will be queued later as pending, so that the
+// flush waits for it, and it should be released once queued.
+func (w *Webhook) hold() {
+	w.pending.Add(1)
+}
+
+func (w *Webhook) release() {
+	w.pending.Add(-1)
+}
+
+func (w *Webhook) enqueue(url string, data map[string]any) {
+	w.enqueueWithDone(url, data, nil)
+}
+
+// enqueueWithDone queues the event, and calls done with the final outcome
+// once it's delivered or dead.
+func (w *Webhook) enqueueWithDone(url string, data map[string]any, done func(error)) {
+	body, _ := json.Marshal(data)
+	action, _ := data["action"].(string)
+	w.pending.Add(1)
+	w.push(&webhookDelivery{url: url, action: action, body: body, createdAt: time.Now(), done: done})
+}
+
+func (w *Webhook) push(d *webhookDelivery) {
+	w.Lock()
+	flushed := w.flushed
+	w.Unlock()
+	if flushed {
+		w.dead(d, fmt.Errorf("flush deadline"))
+		return
+	}
+
+	select {
+	case w.queue <- d:
+	default:
+		w.dead(d, fmt.Errorf("queue full"))
+	}
+}
+
+func (w *Webhook) retry(d *webhookDelivery, delay time.Duration) {
+	w.Lock()
+	if !w.flushed {
+		w.waiting[d] = time.AfterFunc(delay, func() {
+			w.Lock()
+			delete(w.waiting, d)
+			w.Unlock()
+			w.push(d)
+		})
+		w.Unlock()
+		return
+	}
+	w.Unlock()
+	w.dead(d, fmt.Errorf("flush deadline"))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookBackoffBase << (attempts - 1)
+	if delay <= 0 || delay > webhookBackoffMax {
+		delay = webhookBackoffMax
+	}
+	return delay
+}
+
+func (w *Webhook) breakerWait(url string) time.Duration {
+	w.Lock()
+	defer w.Unlock()
+
+	b := w.breakers[url]
+	if b == nil {
+		return 0
+	}
+	return time.Until(b.openUntil)
+}
+
+// breakerReport opens the breaker of the endpoint when its consecutive
+// failures reach the threshold, a failed attempt after the cooldown opens
+// it again, and any success closes it.
+func (w *Webhook) breakerReport(url string, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if err == nil {
+		delete(w.breakers, url)
+		return
+	}
+	b := w.breakers[url]
+	if b == nil {
+		b = &webhookBreaker{}
+		w.breakers[url] = b
+	}
+	b.failures += 1
+	if b.failures >= w.threshold {
+		if time.Now().After(b.openUntil) {
+			logger.Printf("Webhook.breakerReport(%s) open after %d failures\n", url, b.failures)
+		}
+		b.openUntil = time.Now().Add(w.cooldown)
+	}
+}
+
+// dead writes the event to the dead letter log as a JSON line, or to the
+// engine log if the dead letter file is not configured.
+func (w *Webhook) dead(d *webhookDelivery, err error) {
+	w.pending.Add(-1)
+	metricCallbacks.WithLabelValues("dead").Inc()
+	if d.done != nil {
+		defer d.done(err)
+	}
+	line, _ := json.Marshal(map[string]any{
+		"url":        d.url,
+		"action":     d.action,
+		"body":       json.RawMessage(d.body),
+		"attempts":   d.attempts,
+		"error":      err.Error(),
+		"created_at": d.createdAt,
+		"dead_at":    time.Now(),
+	})
+	logger.Printf("Webhook.dead(%s, %s) %d attempts with %v\n", d.url, d.action, d.attempts, err)
+	if w.deadLetter == "" {
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	f, err := os.OpenFile(w.deadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Printf("Webhook.dead(%s) open error %v\n", w.deadLetter, err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+func (w *Webhook) post(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, "sha256="+signBody(w.secret, ts, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return webhookStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+type webhookStatusError int
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("status: %d", int(e))
+}
+
+// webhookRetryable tells whether the failed post may succeed later, the
+// responses other than the server errors are the answers of the callback.
+func webhookRetryable(err error) bool {
+	status, ok := err.(webhookStatusError)
+	return !ok || status >= 500
+}
+
+// signBody returns the hex HMAC-SHA256 of the timestamp and the body.
+func signBody(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// event queues the action of the peer to its callback, the cid is given
+// because the peer may have been closed.
+func (peer *Peer) event(cid, action string, fields map[string]any) {
+	if peer.callback == "" || peer.webhook == nil {
+		return
+	}
+	data := map[string]any{
+		"rid":    peer.rid,
+		"uid":    peer.uid,
+		"cid":    cid,
+		"action": action,
+	}
+	maps.Copy(data, fields)
+	peer.webhook.enqueue(peer.callback, data)
+}
+
+// closed posts the onclose event of the peer, and the onempty event to all
+// the callbacks of the room once its last live peer is closed.
+func (r *Router) closed(peer *Peer, cid, reason string) {
+	peer.event(cid, "onclose", map[string]any{"reason": reason})
+
+	room := r.engine.getRoom(peer.rid)
+	if room == nil {
+		return
+	}
+	room.Lock()
+	empty := !room.empty && !room.active("")
+	callbacks := make(map[string]bool)
+	if empty {
+		room.empty = true
+		for _, p := range room.m {
+			if p.callback != "" {
+				callbacks[p.callback] = true
+			}
+		}
+	}
+	room.Unlock()
+
+	for cbk := range callbacks {
+		r.engine.webhook.enqueue(cbk, map[string]any{
+			"rid":    peer.rid,
+			"action": "onempty",
+		})
+	}
+}
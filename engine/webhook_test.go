@@ -0,0 +1,21 @@
+package engine
+
+import "testing"
+
+func TestSignBody(t *testing.T) {
+	cases := []struct {
+		secret string
+		ts     string
+		body   string
+		want   string
+	}{
+		{"secret", "1700000000", `{"action":"ontrack"}`, "ce7a7ca57dc3e265311ba349b77dc6d1500cafe54f56c6d90fd193dc188a6c14"},
+		{"Jefe", "1700000000", "what do ya want for nothing?", "1cdd0650c8be1cb0974b1788d458b1e781206cfef59b85faafc582d2e182c57e"},
+		{"", "0", "", "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+	}
+	for _, c := range cases {
+		if got := signBody(c.secret, c.ts, []byte(c.body)); got != c.want {
+			t.Fatalf("signBody(%q, %q, %q) = %s, want %s", c.secret, c.ts, c.body, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	whipBodyLimit = 1024 * 1024
+)
+
+func (impl *R) whip(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	impl.ingest(w, r, params, "whip")
+}
+
+func (impl *R) whep(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	impl.ingest(w, r, params, "whep")
+}
+
+func (impl *R) ingest(w http.ResponseWriter, r *http.Request, params map[string]string, kind string) {
+	rid, uid, startAt := params["rid"], params["uid"], time.Now()
+	logger.Printf("RPC.%s(%s, %s)\n", kind, rid, uid)
+	method := map[string]string{"whip": "publish", "whep": "subscribe"}[kind]
+	if err := impl.authorizeIngest(r, method, rid, uid); err != nil {
+		observeCall(kind, startAt, err)
+		renderIngestError(w, err)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, whipBodyLimit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jsep, _ := json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)})
+
+	var cid string
+	var answer *webrtc.SessionDescription
+	switch kind {
+	case "whip":
+		cid, answer, err = impl.router.publish(rid, uid, string(jsep), 0, "", false)
+	case "whep":
+		cid, answer, err = impl.router.watch(rid, uid, string(jsep))
+	}
+	observeCall(kind, startAt, err)
+	if err != nil {
+		renderIngestError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("/%s/%s/%s/%s", kind, rid, uid, cid))
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", cid))
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer.SDP))
+}
+
+func (impl *R) ingestTrickle(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	rid, uid, cid := params["rid"], params["uid"], params["cid"]
+	if err := impl.authorizeIngest(r, "trickle", rid, uid); err != nil {
+		renderIngestError(w, err)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+		http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, whipBodyLimit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var mid string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			ici := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				ici.SDPMid = &mid
+			}
+			candi, _ := json.Marshal(ici)
+			err := impl.router.trickle(rid, uid, cid, string(candi))
+			if err != nil {
+				renderIngestError(w, err)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (impl *R) ingestEnd(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	rid, uid, cid := params["rid"], params["uid"], params["cid"]
+	logger.Printf("RPC.ingestEnd(%s, %s, %s)\n", rid, uid, cid)
+	if err := impl.authorizeIngest(r, "end", rid, uid); err != nil {
+		renderIngestError(w, err)
+		return
+	}
+	err := impl.router.end(rid, uid, cid)
+	if err != nil {
+		renderIngestError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (impl *R) authorizeIngest(r *http.Request, method, rid, uid string) error {
+	call := &Call{
+		Method: method,
+		Params: []any{rid, uid},
+		Token:  bearerToken(r.Header.Get("Authorization")),
+	}
+	return impl.authorize(call)
+}
+
+func renderIngestError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var e Error
+	if errors.As(err, &e) {
+		switch {
+		case e.Code == ErrorUnauthorized:
+			status = http.StatusUnauthorized
+		case e.Code == ErrorPeerBanned:
+			status = http.StatusForbidden
+		case e.Code == ErrorRoomFull || e.Code == ErrorEngineDraining:
+			status = http.StatusServiceUnavailable
+		case e.Code >= ErrorPeerNotFound && e.Code <= ErrorTrackNotFound:
+			status = http.StatusNotFound
+		case e.Code < ErrorRoomFull:
+			status = http.StatusBadRequest
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
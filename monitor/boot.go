@@ -1,5 +1,13 @@
 package monitor
 
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
 func Boot(cp string) {
 	conf, err := Setup(cp)
 	if err != nil {
@@ -10,7 +18,17 @@ func Boot(cp string) {
 	if err != nil {
 		panic(err)
 	}
+	go func() {
+		sc := make(chan os.Signal, 1)
+		signal.Notify(sc, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sc
+		logger.Printf("Boot() signal %s\n", sig)
+		monitor.Close()
+		os.Exit(0)
+	}()
 
 	go monitor.Loop()
-	ServeRPC(monitor, conf)
+	err = ServeRPC(monitor, conf)
+	logger.Printf("ServeRPC() error %v\n", err)
+	monitor.Close()
 }
@@ -9,8 +9,28 @@ import (
 
 type Configuration struct {
 	RPC struct {
-		Port int `toml:"port"`
+		Port   int    `toml:"port"`
+		Secret string `toml:"secret"`
 	} `toml:"rpc"`
+	Persistence struct {
+		Driver string `toml:"driver"`
+		Path   string `toml:"path"`
+	} `toml:"persistence"`
+	Scaling struct {
+		Backend        string `toml:"backend"`
+		MinEngines     int    `toml:"min-engines"`
+		MaxEngines     int    `toml:"max-engines"`
+		PeersPerEngine int    `toml:"peers-per-engine"`
+		Cooldown       int    `toml:"cooldown"`
+		DrainTimeout   int    `toml:"drain-timeout"`
+		Local          struct {
+			Binary  string `toml:"binary"`
+			Config  string `toml:"config"`
+			Dir     string `toml:"dir"`
+			PortMin int    `toml:"port-min"`
+			PortMax int    `toml:"port-max"`
+		} `toml:"local"`
+	} `toml:"scaling"`
 }
 
 func Setup(path string) (*Configuration, error) {
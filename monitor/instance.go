@@ -1,4 +1,32 @@
 package monitor
 
+import (
+	"fmt"
+	"time"
+)
+
+type Node struct {
+	Id        string    `json:"id"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	DrainedAt time.Time `json:"drained_at"`
+}
+
+// Instance is the backend to provision engine instances, the node id
+// must be the same id the engine registers to the monitor.
 type Instance interface {
+	Create() (*Node, error)
+	Destroy(id string) error
+	List() ([]*Node, error)
+	Drain(id string) error
+}
+
+func buildInstance(conf *Configuration) (Instance, error) {
+	switch conf.Scaling.Backend {
+	case "":
+		return nil, nil
+	case "local":
+		return NewLocalInstance(conf)
+	}
+	return nil, fmt.Errorf("invalid scaling backend %s", conf.Scaling.Backend)
 }
@@ -0,0 +1,271 @@
+//go:build unix
+
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+	"github.com/pelletier/go-toml"
+)
+
+const localAdoptPollPeriod = time.Second
+
+type localProcess struct {
+	node    *Node
+	port    int
+	process *os.Process
+	done    chan struct{}
+}
+
+// LocalInstance runs the engines as child processes of the monitor, each
+// with its own RPC port and a configuration generated from the template.
+// The pid of each engine is written to the directory, so that a restarted
+// monitor adopts the engines still running instead of orphaning them.
+type LocalInstance struct {
+	sync.Mutex
+	binary   string
+	template string
+	dir      string
+	monitor  string
+	secret   string
+	portMin  int
+	portMax  int
+	procs    map[string]*localProcess
+}
+
+func NewLocalInstance(conf *Configuration) (*LocalInstance, error) {
+	lc := conf.Scaling.Local
+	binary := lc.Binary
+	if binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		binary = exe
+	}
+	if lc.Config == "" {
+		return nil, fmt.Errorf("empty local engine config template")
+	}
+	if lc.PortMin <= 0 || lc.PortMax < lc.PortMin {
+		return nil, fmt.Errorf("invalid local engine ports %d-%d", lc.PortMin, lc.PortMax)
+	}
+	err := os.MkdirAll(lc.Dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	li := &LocalInstance{
+		binary:   binary,
+		template: lc.Config,
+		dir:      lc.Dir,
+		monitor:  fmt.Sprintf("http://127.0.0.1:%d", conf.RPC.Port),
+		secret:   conf.RPC.Secret,
+		portMin:  lc.PortMin,
+		portMax:  lc.PortMax,
+		procs:    make(map[string]*localProcess),
+	}
+	li.adopt()
+	return li, nil
+}
+
+// adopt finds the engines started by a previous monitor from the pid files,
+// the ones still running with their configurations are watched until they
+// exit, and the stale pid files are removed.
+func (li *LocalInstance) adopt() {
+	pids, _ := filepath.Glob(filepath.Join(li.dir, "local-*.pid"))
+	for _, pf := range pids {
+		id := strings.TrimSuffix(filepath.Base(pf), ".pid")
+		port, err := strconv.Atoi(strings.TrimPrefix(id, "local-"))
+		if err != nil {
+			os.Remove(pf)
+			continue
+		}
+		data, err := os.ReadFile(pf)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || !li.running(pid, id) {
+			os.Remove(pf)
+			continue
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			os.Remove(pf)
+			continue
+		}
+		createdAt := time.Now()
+		if fi, err := os.Stat(pf); err == nil {
+			createdAt = fi.ModTime()
+		}
+		proc := &localProcess{
+			node:    &Node{Id: id, URL: fmt.Sprintf("http://127.0.0.1:%d", port), CreatedAt: createdAt},
+			port:    port,
+			process: process,
+			done:    make(chan struct{}),
+		}
+		li.procs[id] = proc
+		go li.watch(id, proc)
+		logger.Printf("LocalInstance.adopt(%s, %d) pid %d\n", id, port, pid)
+	}
+}
+
+// running tells whether the pid is the engine of the id, the pid file of
+// the id must still hold the pid, and the process must take the signal 0.
+func (li *LocalInstance) running(pid int, id string) bool {
+	data, err := os.ReadFile(filepath.Join(li.dir, id+".pid"))
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(pid) {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// watch polls the adopted engine, which is not a child of the monitor to
+// wait, and cleans it up once it exits.
+func (li *LocalInstance) watch(id string, proc *localProcess) {
+	for li.running(proc.process.Pid, id) {
+		time.Sleep(localAdoptPollPeriod)
+	}
+	logger.Printf("LocalInstance(%s) adopted exited\n", id)
+	li.exited(id, proc)
+}
+
+func (li *LocalInstance) exited(id string, proc *localProcess) {
+	li.Lock()
+	if li.procs[id] == proc {
+		delete(li.procs, id)
+		os.Remove(filepath.Join(li.dir, id+".pid"))
+	}
+	li.Unlock()
+	close(proc.done)
+}
+
+func (li *LocalInstance) Create() (*Node, error) {
+	li.Lock()
+	defer li.Unlock()
+
+	port := 0
+	used := make(map[int]bool)
+	for _, p := range li.procs {
+		used[p.port] = true
+	}
+	for i := li.portMin; i <= li.portMax; i++ {
+		if !used[i] {
+			port = i
+			break
+		}
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("no local engine port available in %d-%d", li.portMin, li.portMax)
+	}
+
+	id := fmt.Sprintf("local-%d", port)
+	url := fmt.Sprintf("http://127.0.0.1:%d", port)
+	tree, err := toml.LoadFile(li.template)
+	if err != nil {
+		return nil, err
+	}
+	tree.Set("rpc.port", int64(port))
+	tree.Set("monitor.endpoint", li.monitor)
+	tree.Set("monitor.id", id)
+	tree.Set("monitor.url", url)
+	tree.Set("monitor.secret", li.secret)
+	// the local engines can't share the single ICE ports or the TURN server
+	tree.Set("engine.udp-port", int64(0))
+	tree.Set("engine.tcp-port", int64(0))
+	tree.Set("turn.listen", "")
+	cp := filepath.Join(li.dir, id+".toml")
+	err = os.WriteFile(cp, []byte(tree.String()), 0600)
+	if err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(li.dir, id+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(li.binary, "-s", "engine", "-c", cp)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	err = cmd.Start()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	err = os.WriteFile(filepath.Join(li.dir, id+".pid"), []byte(pid), 0600)
+	if err != nil {
+		logger.Printf("LocalInstance.Create(%s) pid file error %v\n", id, err)
+	}
+	proc := &localProcess{
+		node:    &Node{Id: id, URL: url, CreatedAt: time.Now()},
+		port:    port,
+		process: cmd.Process,
+		done:    make(chan struct{}),
+	}
+	li.procs[id] = proc
+	go func() {
+		err := cmd.Wait()
+		log.Close()
+		logger.Printf("LocalInstance(%s) exited with %v\n", id, err)
+		li.exited(id, proc)
+	}()
+	logger.Printf("LocalInstance.Create(%s, %d) pid %d\n", id, port, cmd.Process.Pid)
+	n := *proc.node
+	return &n, nil
+}
+
+func (li *LocalInstance) Destroy(id string) error {
+	li.Lock()
+	proc := li.procs[id]
+	li.Unlock()
+	if proc == nil {
+		return fmt.Errorf("local engine %s not found", id)
+	}
+
+	logger.Printf("LocalInstance.Destroy(%s)\n", id)
+	err := proc.process.Kill()
+	if err != nil {
+		return err
+	}
+	<-proc.done
+	return nil
+}
+
+func (li *LocalInstance) List() ([]*Node, error) {
+	li.Lock()
+	defer li.Unlock()
+
+	nodes := make([]*Node, 0, len(li.procs))
+	for _, p := range li.procs {
+		n := *p.node
+		nodes = append(nodes, &n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes, nil
+}
+
+func (li *LocalInstance) Drain(id string) error {
+	li.Lock()
+	defer li.Unlock()
+
+	proc := li.procs[id]
+	if proc == nil {
+		return fmt.Errorf("local engine %s not found", id)
+	}
+	if !proc.node.DrainedAt.IsZero() {
+		return nil
+	}
+	logger.Printf("LocalInstance.Drain(%s)\n", id)
+	proc.node.DrainedAt = time.Now()
+	return proc.process.Signal(syscall.SIGTERM)
+}
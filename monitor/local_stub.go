@@ -0,0 +1,16 @@
+//go:build !unix
+
+package monitor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+type LocalInstance struct {
+	Instance
+}
+
+func NewLocalInstance(conf *Configuration) (*LocalInstance, error) {
+	return nil, fmt.Errorf("local scaling backend not available on %s", runtime.GOOS)
+}
@@ -1,11 +1,261 @@
 package monitor
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine"
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	monitorLoopPeriod      = 5 * time.Second
+	engineHeartbeatTimeout = 30 * time.Second
+	engineExpireTimeout    = 10 * time.Minute
+	roomAssignmentExpire   = 24 * time.Hour
+)
+
+type Engine struct {
+	Id           string       `json:"id"`
+	URL          string       `json:"url"`
+	State        engine.State `json:"state"`
+	Alive        bool         `json:"alive"`
+	Draining     bool         `json:"draining"`
+	RegisteredAt time.Time    `json:"registered_at"`
+	HeartbeatAt  time.Time    `json:"heartbeat_at"`
+}
+
+type Assignment struct {
+	Room       string    `json:"room"`
+	Engine     string    `json:"engine"`
+	AssignedAt time.Time `json:"assigned_at"`
+	RoutedAt   time.Time `json:"routed_at"`
+}
+
 type Monitor struct {
+	sync.RWMutex
+	engines map[string]*Engine
+	rooms   map[string]*Assignment
+	store   Persistence
+	scaler  *scaler
 }
 
 func BuildMonitor(conf *Configuration) (*Monitor, error) {
-	return nil, nil
+	store, err := buildPersistence(conf)
+	if err != nil {
+		return nil, err
+	}
+	scaler, err := buildScaler(conf)
+	if err != nil {
+		return nil, err
+	}
+	monitor := &Monitor{
+		engines: make(map[string]*Engine),
+		rooms:   make(map[string]*Assignment),
+		store:   store,
+		scaler:  scaler,
+	}
+	return monitor, monitor.restore()
 }
 
+// restore loads the persisted engines as dead until they register or send
+// a heartbeat, they have the heartbeat timeout to do it, and the rooms
+// pinned to them are kept.
+func (monitor *Monitor) restore() error {
+	engines, err := monitor.store.ListEngines()
+	if err != nil {
+		return err
+	}
+	rooms, err := monitor.store.ListAssignments()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range engines {
+		e.Alive = false
+		e.HeartbeatAt = now
+		monitor.engines[e.Id] = e
+	}
+	for _, a := range rooms {
+		a.RoutedAt = now
+		monitor.rooms[a.Room] = a
+	}
+	logger.Printf("Monitor.restore() %d engines and %d rooms\n", len(engines), len(rooms))
+	return nil
+}
+
+// Close closes the store once the pending writes are done, it's called
+// before the monitor exits.
+func (monitor *Monitor) Close() error {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	err := monitor.store.Close()
+	logger.Printf("Monitor.Close() with %v\n", err)
+	return err
+}
+
+func (monitor *Monitor) persist(err error, action string, id string) {
+	if err != nil {
+		logger.Printf("Monitor.persist(%s, %s) error %s\n", action, id, err.Error())
+	}
+}
+
+// Loop marks the engines without heartbeat in time as dead, and forgets
+// them if they are still missing after the expiration, then scales the
+// engines if a backend is configured.
 func (monitor *Monitor) Loop() {
+	for {
+		monitor.Lock()
+		for id, e := range monitor.engines {
+			since := time.Since(e.HeartbeatAt)
+			if since > engineExpireTimeout {
+				delete(monitor.engines, id)
+				monitor.persist(monitor.store.DeleteEngine(id), "DeleteEngine", id)
+				logger.Printf("Monitor.Loop() engine %s expired\n", id)
+			} else if since > engineHeartbeatTimeout && e.Alive {
+				e.Alive = false
+				logger.Printf("Monitor.Loop() engine %s dead\n", id)
+			}
+		}
+		for rid, a := range monitor.rooms {
+			if time.Since(a.RoutedAt) > roomAssignmentExpire {
+				delete(monitor.rooms, rid)
+				monitor.persist(monitor.store.DeleteAssignment(rid), "DeleteAssignment", rid)
+			}
+		}
+		monitor.Unlock()
+		monitor.scale()
+		time.Sleep(monitorLoopPeriod)
+	}
+}
+
+func (monitor *Monitor) register(id, url string) (*Engine, error) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	now := time.Now()
+	e := monitor.engines[id]
+	if e == nil {
+		e = &Engine{Id: id, RegisteredAt: now}
+		monitor.engines[id] = e
+	}
+	e.URL = url
+	e.Alive = true
+	e.Draining = false
+	e.HeartbeatAt = now
+	monitor.persist(monitor.store.SaveEngine(e), "SaveEngine", id)
+	logger.Printf("Monitor.register(%s, %s)\n", id, url)
+	c := *e
+	return &c, nil
+}
+
+func (monitor *Monitor) heartbeat(id string, state engine.State) (*Engine, error) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	e := monitor.engines[id]
+	if e == nil {
+		return nil, fmt.Errorf("engine %s not registered", id)
+	}
+	e.State = state
+	e.Alive = true
+	e.HeartbeatAt = time.Now()
+	if state.Draining != e.Draining {
+		e.Draining = state.Draining
+		monitor.persist(monitor.store.SaveEngine(e), "SaveEngine", id)
+		logger.Printf("Monitor.heartbeat(%s) draining %t\n", id, e.Draining)
+	}
+	c := *e
+	return &c, nil
+}
+
+func (monitor *Monitor) list() []*Engine {
+	monitor.RLock()
+	defer monitor.RUnlock()
+
+	engines := make([]*Engine, 0, len(monitor.engines))
+	for _, e := range monitor.engines {
+		c := *e
+		engines = append(engines, &c)
+	}
+	sort.Slice(engines, func(i, j int) bool { return engines[i].Id < engines[j].Id })
+	return engines
+}
+
+func (monitor *Monitor) get(id string) (*Engine, error) {
+	monitor.RLock()
+	defer monitor.RUnlock()
+
+	e := monitor.engines[id]
+	if e == nil {
+		return nil, fmt.Errorf("engine %s not found", id)
+	}
+	c := *e
+	return &c, nil
+}
+
+// route returns the engine of the room, a new room or a room whose engine
+// is gone is pinned to the least loaded alive engine, draining engines
+// keep their rooms but take no new ones. A room pinned to a restored engine
+// fails until the engine confirms or misses its heartbeat.
+func (monitor *Monitor) route(rid string) (*Engine, error) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	now := time.Now()
+	if a := monitor.rooms[rid]; a != nil {
+		e := monitor.engines[a.Engine]
+		if e != nil && e.Alive {
+			a.RoutedAt = now
+			c := *e
+			return &c, nil
+		}
+		if e != nil && now.Sub(e.HeartbeatAt) <= engineHeartbeatTimeout {
+			return nil, fmt.Errorf("engine %s of room %s not confirmed", a.Engine, rid)
+		}
+		logger.Printf("Monitor.route(%s) engine %s gone\n", rid, a.Engine)
+	}
+
+	var best *Engine
+	var bestLoad int
+	for _, e := range monitor.engines {
+		if !e.Alive || e.Draining {
+			continue
+		}
+		load := monitor.load(e)
+		if best == nil || load < bestLoad || (load == bestLoad && e.Id < best.Id) {
+			best, bestLoad = e, load
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no engine available for room %s", rid)
+	}
+	a := &Assignment{
+		Room:       rid,
+		Engine:     best.Id,
+		AssignedAt: now,
+		RoutedAt:   now,
+	}
+	monitor.rooms[rid] = a
+	monitor.persist(monitor.store.SaveAssignment(a), "SaveAssignment", rid)
+	logger.Printf("Monitor.route(%s) pinned to engine %s with load %d\n", rid, best.Id, bestLoad)
+	c := *best
+	return &c, nil
+}
+
+// load is the active and listen peers reported by the engine, plus the rooms pinned
+// to it after the report, so that a burst of new rooms won't all go to
+// the same engine before its next state update.
+func (monitor *Monitor) load(e *Engine) int {
+	load := e.State.ActivePeers + e.State.ListenPeers
+	for _, a := range monitor.rooms {
+		if a.Engine == e.Id && a.AssignedAt.After(e.State.UpdatedAt) {
+			load += 1
+		}
+	}
+	return load
 }
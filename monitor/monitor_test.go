@@ -0,0 +1,80 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/kraken/engine"
+)
+
+func TestRoute(t *testing.T) {
+	now := time.Now()
+	alive := func(id string, peers int) *Engine {
+		return &Engine{Id: id, Alive: true, HeartbeatAt: now, State: engine.State{UpdatedAt: now, ActivePeers: peers}}
+	}
+	draining := func(id string, peers int) *Engine {
+		e := alive(id, peers)
+		e.Draining = true
+		return e
+	}
+	dead := func(id string, since time.Duration) *Engine {
+		return &Engine{Id: id, HeartbeatAt: now.Add(-since), State: engine.State{UpdatedAt: now.Add(-since)}}
+	}
+	pinned := func(rid, id string) *Assignment {
+		return &Assignment{Room: rid, Engine: id, AssignedAt: now.Add(-time.Minute), RoutedAt: now.Add(-time.Minute)}
+	}
+
+	// each room of rids is routed in order, an empty engine wants an error.
+	cases := []struct {
+		name    string
+		engines []*Engine
+		rooms   []*Assignment
+		rids    []string
+		want    []string
+	}{
+		{"new room least loaded", []*Engine{alive("a", 5), alive("b", 2)}, nil, []string{"r"}, []string{"b"}},
+		{"new room tie lowest id", []*Engine{alive("b", 2), alive("a", 2)}, nil, []string{"r"}, []string{"a"}},
+		{"new room skips draining", []*Engine{draining("a", 0), alive("b", 9)}, nil, []string{"r"}, []string{"b"}},
+		{"new room skips dead", []*Engine{dead("a", time.Hour), alive("b", 9)}, nil, []string{"r"}, []string{"b"}},
+		{"no engine", []*Engine{draining("a", 0)}, nil, []string{"r"}, []string{""}},
+		{"burst spread", []*Engine{alive("a", 0), alive("b", 0)}, nil, []string{"r1", "r2", "r3"}, []string{"a", "b", "a"}},
+		{"sticky to loaded", []*Engine{alive("a", 9), alive("b", 0)}, []*Assignment{pinned("r", "a")}, []string{"r", "r"}, []string{"a", "a"}},
+		{"sticky to draining", []*Engine{draining("a", 9), alive("b", 0)}, []*Assignment{pinned("r", "a")}, []string{"r"}, []string{"a"}},
+		{"unconfirmed engine", []*Engine{dead("a", time.Second), alive("b", 0)}, []*Assignment{pinned("r", "a")}, []string{"r"}, []string{""}},
+		{"re-pin missed heartbeat", []*Engine{dead("a", time.Hour), alive("b", 0)}, []*Assignment{pinned("r", "a")}, []string{"r", "r"}, []string{"b", "b"}},
+		{"re-pin forgotten engine", []*Engine{alive("b", 3), alive("c", 1)}, []*Assignment{pinned("r", "a")}, []string{"r"}, []string{"c"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			monitor := &Monitor{
+				engines: make(map[string]*Engine),
+				rooms:   make(map[string]*Assignment),
+				store:   &memoryPersistence{},
+			}
+			for _, e := range c.engines {
+				monitor.engines[e.Id] = e
+			}
+			for _, a := range c.rooms {
+				monitor.rooms[a.Room] = a
+			}
+			for i, rid := range c.rids {
+				e, err := monitor.route(rid)
+				if c.want[i] == "" {
+					if err == nil {
+						t.Fatalf("route(%s) = %s, want error", rid, e.Id)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("route(%s) error %v, want %s", rid, err, c.want[i])
+				}
+				if e.Id != c.want[i] {
+					t.Fatalf("route(%s) = %s, want %s", rid, e.Id, c.want[i])
+				}
+				if a := monitor.rooms[rid]; a == nil || a.Engine != e.Id {
+					t.Fatalf("route(%s) assignment %v, want %s", rid, a, e.Id)
+				}
+			}
+		})
+	}
+}
@@ -1 +1,147 @@
 package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	persistenceBucketEngines = "engines"
+	persistenceBucketRooms   = "rooms"
+	persistenceDefaultPath   = "kraken-monitor.db"
+)
+
+// Persistence stores the engine registrations and room assignments, so
+// that a restarted monitor still routes the live rooms to their engines.
+type Persistence interface {
+	SaveEngine(e *Engine) error
+	DeleteEngine(id string) error
+	ListEngines() ([]*Engine, error)
+	SaveAssignment(a *Assignment) error
+	DeleteAssignment(rid string) error
+	ListAssignments() ([]*Assignment, error)
+	Close() error
+}
+
+// buildPersistence opens the configured driver, the bolt database is the
+// default, at the path in the working directory if not set.
+func buildPersistence(conf *Configuration) (Persistence, error) {
+	switch conf.Persistence.Driver {
+	case "", "bolt":
+		path := conf.Persistence.Path
+		if path == "" {
+			path = persistenceDefaultPath
+		}
+		return OpenBoltPersistence(path)
+	case "memory":
+		return &memoryPersistence{}, nil
+	}
+	return nil, fmt.Errorf("invalid persistence driver %s", conf.Persistence.Driver)
+}
+
+type BoltPersistence struct {
+	db *bolt.DB
+}
+
+func OpenBoltPersistence(path string) (*BoltPersistence, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty persistence path")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{persistenceBucketEngines, persistenceBucketRooms} {
+			_, err := tx.CreateBucketIfNotExists([]byte(b))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltPersistence{db: db}, nil
+}
+
+func (p *BoltPersistence) SaveEngine(e *Engine) error {
+	return p.put(persistenceBucketEngines, e.Id, e)
+}
+
+func (p *BoltPersistence) DeleteEngine(id string) error {
+	return p.delete(persistenceBucketEngines, id)
+}
+
+func (p *BoltPersistence) ListEngines() ([]*Engine, error) {
+	engines := make([]*Engine, 0)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistenceBucketEngines)).ForEach(func(k, v []byte) error {
+			var e Engine
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			engines = append(engines, &e)
+			return nil
+		})
+	})
+	return engines, err
+}
+
+func (p *BoltPersistence) SaveAssignment(a *Assignment) error {
+	return p.put(persistenceBucketRooms, a.Room, a)
+}
+
+func (p *BoltPersistence) DeleteAssignment(rid string) error {
+	return p.delete(persistenceBucketRooms, rid)
+}
+
+func (p *BoltPersistence) ListAssignments() ([]*Assignment, error) {
+	rooms := make([]*Assignment, 0)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(persistenceBucketRooms)).ForEach(func(k, v []byte) error {
+			var a Assignment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			rooms = append(rooms, &a)
+			return nil
+		})
+	})
+	return rooms, err
+}
+
+func (p *BoltPersistence) Close() error {
+	return p.db.Close()
+}
+
+func (p *BoltPersistence) put(bucket, key string, val any) error {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), b)
+	})
+}
+
+func (p *BoltPersistence) delete(bucket, key string) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+type memoryPersistence struct{}
+
+func (p *memoryPersistence) SaveEngine(e *Engine) error              { return nil }
+func (p *memoryPersistence) DeleteEngine(id string) error            { return nil }
+func (p *memoryPersistence) ListEngines() ([]*Engine, error)         { return nil, nil }
+func (p *memoryPersistence) SaveAssignment(a *Assignment) error      { return nil }
+func (p *memoryPersistence) DeleteAssignment(rid string) error       { return nil }
+func (p *memoryPersistence) ListAssignments() ([]*Assignment, error) { return nil, nil }
+func (p *memoryPersistence) Close() error                            { return nil }
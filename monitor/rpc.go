@@ -1,11 +1,15 @@
 package monitor
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/MixinNetwork/kraken/engine"
 	"github.com/dimfeld/httptreemux/v5"
 	"github.com/gorilla/handlers"
 	"github.com/unrolled/render"
@@ -13,6 +17,7 @@ import (
 
 type R struct {
 	monitor *Monitor
+	secret  string
 }
 
 type Call struct {
@@ -44,20 +49,149 @@ func (r *Render) RenderError(err error) {
 }
 
 func (impl *R) handle(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		render.New().JSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+		return
+	}
 	var call Call
-	d := json.NewDecoder(r.Body)
+	d := json.NewDecoder(bytes.NewReader(body))
 	d.UseNumber()
 	if err := d.Decode(&call); err != nil {
 		render.New().JSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
 		return
 	}
 	renderer := &Render{w: w, impl: render.New(), id: call.Id}
+	if err := impl.authenticate(r, call.Method, body); err != nil {
+		renderer.RenderError(err)
+		return
+	}
 	switch call.Method {
+	case "register":
+		e, err := impl.register(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(e)
+		}
+	case "heartbeat":
+		e, err := impl.heartbeat(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(e)
+		}
+	case "engines":
+		engines, err := impl.engines(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]any{"engines": engines})
+		}
+	case "engine":
+		e, err := impl.engine(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(e)
+		}
+	case "route":
+		e, err := impl.route(call.Params)
+		if err != nil {
+			renderer.RenderError(err)
+		} else {
+			renderer.RenderData(map[string]any{"engine": e.Id, "url": e.URL})
+		}
 	default:
 		renderer.RenderError(fmt.Errorf("invalid method %s", call.Method))
 	}
 }
 
+// authenticate checks the signature of the engine calls by the secret shared
+// with the engines, which must be configured for the engines to register.
+func (impl *R) authenticate(r *http.Request, method string, body []byte) error {
+	if method != "register" && method != "heartbeat" {
+		return nil
+	}
+	if impl.secret == "" {
+		return fmt.Errorf("method %s requires the rpc secret configured", method)
+	}
+	ts := r.Header.Get(engine.MonitorTimestampHeader)
+	signature := r.Header.Get(engine.MonitorSignatureHeader)
+	err := engine.VerifySignature(impl.secret, ts, signature, body)
+	if err != nil {
+		return fmt.Errorf("method %s unauthorized %v", method, err)
+	}
+	return nil
+}
+
+func (r *R) register(params []any) (*Engine, error) {
+	if len(params) != 2 {
+		return nil, fmt.Errorf("invalid params count %d", len(params))
+	}
+	id, ok := params[0].(string)
+	if !ok || id == "" {
+		return nil, fmt.Errorf("invalid id %v", params[0])
+	}
+	uri, ok := params[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid url type %v", params[1])
+	}
+	if u, err := url.Parse(uri); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid url %s", uri)
+	}
+	return r.monitor.register(id, uri)
+}
+
+func (r *R) heartbeat(params []any) (*Engine, error) {
+	if len(params) != 2 {
+		return nil, fmt.Errorf("invalid params count %d", len(params))
+	}
+	id, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid id type %v", params[0])
+	}
+	b, err := json.Marshal(params[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid state %v", params[1])
+	}
+	var state engine.State
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state %v %v", params[1], err)
+	}
+	return r.monitor.heartbeat(id, state)
+}
+
+func (r *R) engines(params []any) ([]*Engine, error) {
+	if len(params) != 0 {
+		return nil, fmt.Errorf("invalid params count %d", len(params))
+	}
+	return r.monitor.list(), nil
+}
+
+func (r *R) engine(params []any) (*Engine, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("invalid params count %d", len(params))
+	}
+	id, ok := params[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid id type %v", params[0])
+	}
+	return r.monitor.get(id)
+}
+
+func (r *R) route(params []any) (*Engine, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("invalid params count %d", len(params))
+	}
+	rid, ok := params[0].(string)
+	if !ok || rid == "" {
+		return nil, fmt.Errorf("invalid rid %v", params[0])
+	}
+	return r.monitor.route(rid)
+}
+
 func registerHanders(router *httptreemux.TreeMux) {
 	router.MethodNotAllowedHandler = func(w http.ResponseWriter, r *http.Request, _ map[string]httptreemux.HandlerFunc) {
 		render.New().JSON(w, http.StatusNotFound, map[string]any{"error": "not found"})
@@ -71,7 +205,7 @@ func registerHanders(router *httptreemux.TreeMux) {
 }
 
 func ServeRPC(monitor *Monitor, conf *Configuration) error {
-	impl := &R{monitor: monitor}
+	impl := &R{monitor: monitor, secret: conf.RPC.Secret}
 	router := httptreemux.New()
 	router.POST("/", impl.handle)
 	registerHanders(router)
@@ -0,0 +1,161 @@
+package monitor
+
+import (
+	"time"
+
+	"github.com/MixinNetwork/mixin/logger"
+)
+
+const (
+	scalingDefaultCooldown     = 60
+	scalingDefaultDrainTimeout = 3600
+	scalingDownThreshold       = 0.75
+)
+
+type scaler struct {
+	instance       Instance
+	min            int
+	max            int
+	peersPerEngine int
+	cooldown       time.Duration
+	drainTimeout   time.Duration
+	actedAt        time.Time
+}
+
+func buildScaler(conf *Configuration) (*scaler, error) {
+	instance, err := buildInstance(conf)
+	if err != nil || instance == nil {
+		return nil, err
+	}
+	sc := conf.Scaling
+	s := &scaler{
+		instance:       instance,
+		min:            sc.MinEngines,
+		max:            sc.MaxEngines,
+		peersPerEngine: sc.PeersPerEngine,
+		cooldown:       time.Duration(sc.Cooldown) * time.Second,
+		drainTimeout:   time.Duration(sc.DrainTimeout) * time.Second,
+	}
+	if s.min < 0 {
+		s.min = 0
+	}
+	if s.max < s.min {
+		s.max = s.min
+	}
+	if s.peersPerEngine <= 0 {
+		s.peersPerEngine = 100
+	}
+	if s.cooldown <= 0 {
+		s.cooldown = scalingDefaultCooldown * time.Second
+	}
+	if s.drainTimeout <= 0 {
+		s.drainTimeout = scalingDefaultDrainTimeout * time.Second
+	}
+	return s, nil
+}
+
+// scale keeps the engines between min and max, adds one engine when the
+// active peers exceed the capacity, and drains the least loaded managed
+// engine when the others could take its peers with some headroom. The
+// drained engines are destroyed once empty or after the drain timeout.
+func (monitor *Monitor) scale() {
+	s := monitor.scaler
+	if s == nil {
+		return
+	}
+	nodes, err := s.instance.List()
+	if err != nil {
+		logger.Printf("Monitor.scale() list error %s\n", err.Error())
+		return
+	}
+
+	monitor.Lock()
+	managed := make(map[string]bool)
+	var destroy []string
+	active, pending := 0, 0
+	for _, n := range nodes {
+		managed[n.Id] = true
+		e := monitor.engines[n.Id]
+		if !n.DrainedAt.IsZero() {
+			idle := e == nil || (e.State.UpdatedAt.After(n.DrainedAt) && e.State.ActivePeers+e.State.ListenPeers == 0)
+			if idle || time.Since(n.DrainedAt) > s.drainTimeout {
+				destroy = append(destroy, n.Id)
+			}
+			continue
+		}
+		if e == nil || !e.Alive {
+			pending += 1
+		}
+	}
+	load := 0
+	var victim *Engine
+	var victimLoad int
+	for _, e := range monitor.engines {
+		if !e.Alive || e.Draining {
+			continue
+		}
+		l := monitor.load(e)
+		load += l
+		active += 1
+		if !managed[e.Id] {
+			continue
+		}
+		if victim == nil || l < victimLoad || (l == victimLoad && e.Id > victim.Id) {
+			victim, victimLoad = e, l
+		}
+	}
+	monitor.Unlock()
+
+	for _, id := range destroy {
+		err := s.instance.Destroy(id)
+		logger.Printf("Monitor.scale() destroy %s %v\n", id, err)
+		if err == nil {
+			monitor.forget(id)
+		}
+	}
+
+	if time.Since(s.actedAt) < s.cooldown {
+		return
+	}
+	total := active + pending
+	switch {
+	case total < s.min || (total < s.max && pending == 0 && load > total*s.peersPerEngine):
+		node, err := s.instance.Create()
+		if err != nil {
+			logger.Printf("Monitor.scale() create error %s\n", err.Error())
+			return
+		}
+		s.actedAt = time.Now()
+		logger.Printf("Monitor.scale() create %s with %d engines and %d peers\n", node.Id, total, load)
+	case victim != nil && pending == 0 && total > s.min &&
+		float64(load) < float64((total-1)*s.peersPerEngine)*scalingDownThreshold:
+		err := s.instance.Drain(victim.Id)
+		if err != nil {
+			logger.Printf("Monitor.scale() drain %s error %s\n", victim.Id, err.Error())
+			return
+		}
+		monitor.drain(victim.Id)
+		s.actedAt = time.Now()
+		logger.Printf("Monitor.scale() drain %s with %d engines and %d peers\n", victim.Id, total, load)
+	}
+}
+
+func (monitor *Monitor) drain(id string) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	e := monitor.engines[id]
+	if e == nil {
+		return
+	}
+	e.Draining = true
+	monitor.persist(monitor.store.SaveEngine(e), "SaveEngine", id)
+}
+
+func (monitor *Monitor) forget(id string) {
+	monitor.Lock()
+	defer monitor.Unlock()
+
+	delete(monitor.engines, id)
+	monitor.persist(monitor.store.DeleteEngine(id), "DeleteEngine", id)
+}